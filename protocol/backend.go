@@ -40,13 +40,35 @@ func ReadyForQueryMessage() []byte {
  *
  * This message provides secret-key data that the frontend must save if it wants to be able to issue cancel requests later.
  *  The frontend should not respond to this message, but should continue listening for a ReadyForQuery message.
+ *  The secret key is 4 bytes long in protocol 3.0, and up to 256 bytes in protocol 3.2.
  */
-func BackendKeyDataMessage(processID, secretKey int32) []byte {
+func BackendKeyDataMessage(processID int32, secretKey []byte) []byte {
 	message := NewMessageBuffer()
 	message.WriteByte(MessageTypeBackendKeyData)
-	message.WriteInt32(12)
+	message.WriteInt32(0)
 	message.WriteInt32(processID)
-	message.WriteInt32(secretKey)
+	message.WriteBytes(secretKey)
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes()
+}
+
+/**
+ * NegotiateProtocolVersion (B)
+ *
+ * This message is sent when the frontend requested a newer minor version of the protocol than the server supports,
+ *  or protocol options (_pq_.*) the server does not recognize. It carries the newest minor version supported
+ *  and the names of the options that were not recognized.
+ */
+func NegotiateProtocolVersionMessage(minorVersion int32, options []string) []byte {
+	message := NewMessageBuffer()
+	message.WriteByte(MessageTypeNegotiateProtocolVersion)
+	message.WriteInt32(0)
+	message.WriteInt32(minorVersion)
+	message.WriteInt32(int32(len(options)))
+	for _, option := range options {
+		message.WriteString(option)
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
 	return message.Bytes()
 }
 
@@ -29,10 +29,10 @@ func CreatePasswordResponseMessage(password string) []byte {
  * This message includes the names of the user and of the database the user wants to connect to;
  * it also identifies the particular protocol version to be used
  */
-func CreateStartupMessage(username string, database string, options map[string]string) []byte {
+func CreateStartupMessage(version int32, username string, database string, options map[string]string) []byte {
 	message := NewMessageBuffer()
 	message.WriteInt32(0)
-	message.WriteInt32(ProtocolVersion)
+	message.WriteInt32(version)
 	message.WriteString("user")
 	message.WriteString(username)
 	message.WriteString("database")
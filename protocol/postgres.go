@@ -1,6 +1,7 @@
 package postgres
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"io"
@@ -100,7 +101,8 @@ func (postgresProxy *PostgresProxy) SendMessage(conn net.Conn, msg []byte) Packe
 func (postgresProxy *PostgresProxy) SendStartupRequest() {
 	params := make(map[string]string)
 	params[PostgresApplicationName] = postgresProxy.DBConnectionParams.ApplicationName
-	msg := CreateStartupMessage(postgresProxy.DBConnectionParams.Username,
+	// The backend leg speaks 3.0, whatever the frontend negotiated
+	msg := CreateStartupMessage(ProtocolVersion, postgresProxy.DBConnectionParams.Username,
 		postgresProxy.DBConnectionParams.DatabaseName, params)
 	postgresProxy.C <- postgresProxy.SendMessage(postgresProxy.forwardConnection, msg)
 }
@@ -135,11 +137,28 @@ func (postgresProxy *PostgresProxy) SendParameterStatus(key, value string) {
 	postgresProxy.C <- postgresProxy.SendMessage(postgresProxy.reverseConnection, message)
 }
 
-func (postgresProxy *PostgresProxy) SendBackendKeyData(processID, secretKey int32) {
+func (postgresProxy *PostgresProxy) SendBackendKeyData(processID int32, secretKey []byte) {
 	message := BackendKeyDataMessage(processID, secretKey)
 	postgresProxy.C <- postgresProxy.SendMessage(postgresProxy.reverseConnection, message)
 }
 
+/**
+ * NegotiateProtocolVersion picks the protocol version of the frontend leg from the version of its startup message.
+ * Frontends asking for a newer minor version than 3.2 get a NegotiateProtocolVersion and go on with 3.2,
+ * 3.1 was never used and 3.1 frontends get 3.0.
+ */
+func (postgresProxy *PostgresProxy) NegotiateProtocolVersion(version int32) int32 {
+	switch {
+	case version > ProtocolVersionLatest:
+		message := NegotiateProtocolVersionMessage(ProtocolMinorVersion(ProtocolVersionLatest), nil)
+		postgresProxy.C <- postgresProxy.SendMessage(postgresProxy.reverseConnection, message)
+		return ProtocolVersionLatest
+	case version >= ProtocolVersion32:
+		return ProtocolVersion32
+	}
+	return ProtocolVersion
+}
+
 func (postgresProxy *PostgresProxy) SendReadyForQuery() {
 	message := ReadyForQueryMessage()
 	postgresProxy.C <- postgresProxy.SendMessage(postgresProxy.reverseConnection, message)
@@ -229,8 +248,11 @@ func (postgresProxy *PostgresProxy) HandleDBConnection() {
 		// Upgrade backend connection to TLS
 		postgresProxy.UpgradeServerConnection()
 		// Read response of frontend for the SSL acknowledgement
-		postgresProxy.ReceiveReverseSSLAckResponse()
+		msg = postgresProxy.ReceiveReverseSSLAckResponse()
+		version = GetVersion(msg.Message)
 	}
+	// Negotiate the protocol version of the frontend
+	protocolVersion := postgresProxy.NegotiateProtocolVersion(version)
 	// Send Password Request to frontend
 	postgresProxy.SendAuthenticationClearTextPasswordRequest()
 	// Read frontend password
@@ -257,8 +279,14 @@ func (postgresProxy *PostgresProxy) HandleDBConnection() {
 	postgresProxy.SendParameterStatus("standard_conforming_strings", "on")
 	// Send Parameter Status
 	postgresProxy.SendParameterStatus("TimeZone", "Etc/UTC")
-	// Send Backend KeyData
-	postgresProxy.SendBackendKeyData(108, 304016105)
+	// Send Backend KeyData, protocol 3.2 frontends get a longer secret key
+	secretKey := make([]byte, 4)
+	if protocolVersion >= ProtocolVersion32 {
+		secretKey = make([]byte, CancelKeyLength32)
+	}
+	_, err := rand.Read(secretKey)
+	postgresProxy.C <- Packet{Error: err}
+	postgresProxy.SendBackendKeyData(108, secretKey)
 	// Send ReadyForQuery
 	postgresProxy.SendReadyForQuery()
 
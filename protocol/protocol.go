@@ -24,6 +24,16 @@ const (
 	 * The least significant 16 bits are the minor version number (0 for the protocol described here).
 	 */
 	ProtocolVersion int32 = 196608
+	/**
+	 * Protocol version 3.2 (PostgreSQL 18), whose BackendKeyData carries a secret key of up to
+	 * MaxCancelKeyLength bytes instead of an int32.
+	 */
+	ProtocolVersion32 int32 = 196610
+	// The newest protocol version the package speaks
+	ProtocolVersionLatest = ProtocolVersion32
+	MaxCancelKeyLength    = 256
+	// Length of the secret keys sent to protocol 3.2 frontends, as PostgreSQL 18 does
+	CancelKeyLength32 = 32
 	/**
 	 * The SSL request code.
 	 * The value is chosen to contain 1234 in the most significant 16 bits, and 5679 in the least significant 16 bits.
@@ -31,6 +41,14 @@ const (
 	SSLRequestCode int32 = 80877103
 )
 
+func ProtocolMajorVersion(version int32) int32 {
+	return version >> 16
+}
+
+func ProtocolMinorVersion(version int32) int32 {
+	return version & 0xffff
+}
+
 /* SSL Responses */
 const (
 	SSLAllowed    byte = 'S'
@@ -46,6 +64,8 @@ const (
 	MessageTypeParameterStatus byte = 'S'
 	//Identifies the message as cancellation key data (B)
 	MessageTypeBackendKeyData byte = 'K'
+	//Identifies the message as a protocol version negotiation (B)
+	MessageTypeNegotiateProtocolVersion byte = 'v'
 	//Identifies the message type ReadyForQuery which is sent whenever the backend is ready for a new query cycle (B)
 	MessageTypeReadyForQuery byte = 'Z'
 	//Identifies the message as a termination (F)
@@ -48,21 +48,53 @@ func ReadyForQueryMessage() (_ []byte, err error) {
  *
  * This message provides secret-key data that the frontend must save if it wants to be able to issue cancel requests later.
  *  The frontend should not respond to this message, but should continue listening for a ReadyForQuery message.
+ *  The secret key is 4 bytes long in protocol 3.0, and up to 256 bytes in protocol 3.2.
  */
-func BackendKeyDataMessage(processID, secretKey int32) (_ []byte, err error) {
+func BackendKeyDataMessage(processID int32, secretKey []byte) (_ []byte, err error) {
 	message := NewMessageBuffer()
 	if err = message.WriteByte(MessageTypeBackendKeyData); err != nil {
 		return
 	}
-	if _, err = message.WriteInt32(12); err != nil {
+	if _, err = message.WriteInt32(0); err != nil {
 		return
 	}
 	if _, err = message.WriteInt32(processID); err != nil {
 		return
 	}
-	if _, err = message.WriteInt32(secretKey); err != nil {
+	if _, err = message.WriteBytes(secretKey); err != nil {
+		return
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
+
+/**
+ * NegotiateProtocolVersion (B)
+ *
+ * This message is sent when the frontend requested a newer minor version of the protocol than the server supports,
+ *  or protocol options (_pq_.*) the server does not recognize. It carries the newest minor version supported
+ *  and the names of the options that were not recognized.
+ */
+func NegotiateProtocolVersionMessage(minorVersion int32, options []string) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeNegotiateProtocolVersion); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(minorVersion); err != nil {
 		return
 	}
+	if _, err = message.WriteInt32(int32(len(options))); err != nil {
+		return
+	}
+	for _, option := range options {
+		if _, err = message.WriteString(option); err != nil {
+			return
+		}
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
 	return message.Bytes(), nil
 }
 
@@ -129,3 +161,171 @@ func AuthenticationClearTextPasswordRequestMessage() (_ []byte, err error) {
 	}
 	return message.Bytes(), nil
 }
+
+/**
+ * ErrorResponse (B)
+ *
+ * The message body consists of one or more identified fields, followed by a zero byte as a terminator.
+ * Fields can appear in any order. For each field there is a byte identifying the field type, followed by a null-terminated string.
+ */
+func ErrorResponseMessage(severity, code, text string) (_ []byte, err error) {
+	return responseMessage(MessageTypeErrorResponse, severity, code, text)
+}
+
+/**
+ * NoticeResponse (B)
+ *
+ * A warning message, with the fields of an ErrorResponse. The frontend should display the message
+ * but continue listening for ReadyForQuery or ErrorResponse.
+ */
+func NoticeResponseMessage(severity, code, text string) (_ []byte, err error) {
+	return responseMessage(MessageTypeNoticeResponse, severity, code, text)
+}
+
+func responseMessage(messageType byte, severity, code, text string) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(messageType); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	fields := []struct {
+		field byte
+		value string
+	}{
+		{ErrorFieldSeverity, severity},
+		{ErrorFieldSeverityNonLocalized, severity},
+		{ErrorFieldCode, code},
+		{ErrorFieldMessage, text},
+	}
+	for _, f := range fields {
+		if err = message.WriteByte(f.field); err != nil {
+			return
+		}
+		if _, err = message.WriteString(f.value); err != nil {
+			return
+		}
+	}
+	if err = message.WriteByte(0x00); err != nil {
+		return
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
+
+/**
+ * ParseComplete (B), BindComplete (B) and CloseComplete (B)
+ *
+ * Indicators without a body, sent on successful completion of Parse, Bind and Close.
+ */
+func CompleteMessage(messageType byte) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(messageType); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(4); err != nil {
+		return
+	}
+	return message.Bytes(), nil
+}
+
+/**
+ * RowDescription (B)
+ *
+ * Describes the columns of the rows about to be returned. The proxy describes its own results
+ * as unnamed text columns, sent in text format.
+ */
+func RowDescriptionMessage(columns []string) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeRowDescription); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteInt16(int16(len(columns))); err != nil {
+		return
+	}
+	for _, column := range columns {
+		if _, err = message.WriteString(column); err != nil {
+			return
+		}
+		// Table OID and column attribute number, none
+		if _, err = message.WriteInt32(0); err != nil {
+			return
+		}
+		if _, err = message.WriteInt16(0); err != nil {
+			return
+		}
+		if _, err = message.WriteInt32(TypeOIDText); err != nil {
+			return
+		}
+		// Type size (variable length), type modifier (none) and format code (text)
+		if _, err = message.WriteInt16(-1); err != nil {
+			return
+		}
+		if _, err = message.WriteInt32(-1); err != nil {
+			return
+		}
+		if _, err = message.WriteInt16(0); err != nil {
+			return
+		}
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
+
+/**
+ * DataRow (B)
+ *
+ * One row of a result, each column value preceded by its length. A nil value is sent as NULL.
+ */
+func DataRowMessage(values [][]byte) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeDataRow); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteInt16(int16(len(values))); err != nil {
+		return
+	}
+	for _, value := range values {
+		if value == nil {
+			if _, err = message.WriteInt32(-1); err != nil {
+				return
+			}
+			continue
+		}
+		if _, err = message.WriteInt32(int32(len(value))); err != nil {
+			return
+		}
+		if _, err = message.WriteBytes(value); err != nil {
+			return
+		}
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
+
+/**
+ * CommandComplete (B)
+ *
+ * The command tag identifies the SQL command that completed, e.g. SELECT 1 or SHOW.
+ */
+func CommandCompleteMessage(tag string) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeCommandComplete); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteString(tag); err != nil {
+		return
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
@@ -23,6 +23,12 @@ func (message *PostgresMessageBuffer) WriteBytes(value []byte) (int, error) {
 	return message.buffer.Write(value)
 }
 
+func (message *PostgresMessageBuffer) WriteInt16(value int16) (int, error) {
+	x := make([]byte, 2)
+	binary.BigEndian.PutUint16(x, uint16(value))
+	return message.WriteBytes(x)
+}
+
 func (message *PostgresMessageBuffer) WriteInt32(value int32) (int, error) {
 	x := make([]byte, 4)
 	binary.BigEndian.PutUint32(x, uint32(value))
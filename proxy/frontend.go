@@ -35,12 +35,12 @@ func CreatePasswordResponseMessage(password string) (_ []byte, err error) {
  * This message includes the names of the user and of the database the user wants to connect to;
  * it also identifies the particular protocol version to be used
  */
-func CreateStartupMessage(username string, database string, options map[string]string) (_ []byte, err error) {
+func CreateStartupMessage(version int32, username string, database string, options map[string]string) (_ []byte, err error) {
 	message := NewMessageBuffer()
 	if _, err = message.WriteInt32(0); err != nil {
 		return
 	}
-	if _, err = message.WriteInt32(ProtocolVersion); err != nil {
+	if _, err = message.WriteInt32(version); err != nil {
 		return
 	}
 	if _, err = message.WriteString(ConnectionAttributeUser); err != nil {
@@ -86,3 +86,146 @@ func SSLRequestMessage() (_ []byte, err error) {
 	}
 	return message.Bytes(), nil
 }
+
+/**
+ * CancelRequest (F)
+ *
+ * To cancel a running query, the frontend opens a new connection and sends a CancelRequest
+ *  with the process ID and secret key the backend sent in BackendKeyData, then closes the connection.
+ */
+func CancelRequestMessage(processID int32, secretKey []byte) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(CancelRequestCode); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(processID); err != nil {
+		return
+	}
+	if _, err = message.WriteBytes(secretKey); err != nil {
+		return
+	}
+	message.ResetLength(0)
+	return message.Bytes(), nil
+}
+
+/**
+ * Query (F)
+ *
+ * A simple query cycle is initiated by the frontend sending a Query message to the backend.
+ * The message includes an SQL command (or commands) expressed as a text string.
+ */
+func CreateQueryMessage(query string) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeQuery); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteString(query); err != nil {
+		return
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
+
+/**
+ * Terminate (F)
+ *
+ * The normal, graceful termination procedure is that the frontend sends a Terminate message and immediately closes the connection.
+ */
+func CreateTerminateMessage() (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeTerminate); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(4); err != nil {
+		return
+	}
+	return message.Bytes(), nil
+}
+
+/**
+ * Parse (F)
+ *
+ * In the extended protocol, the frontend first sends a Parse message, which contains a textual query string,
+ * optionally some information about data types of parameter placeholders, and the name of a destination prepared-statement object.
+ */
+func CreateParseMessage(name, query string, parameterOIDs []int32) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeParse); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteString(name); err != nil {
+		return
+	}
+	if _, err = message.WriteString(query); err != nil {
+		return
+	}
+	if _, err = message.WriteInt16(int16(len(parameterOIDs))); err != nil {
+		return
+	}
+	for _, oid := range parameterOIDs {
+		if _, err = message.WriteInt32(oid); err != nil {
+			return
+		}
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
+
+/**
+ * Bind (F)
+ *
+ * Once a prepared statement exists, it can be readied for execution using a Bind message.
+ * The parameters are the already encoded parameter formats, values and result formats of a Bind message.
+ */
+func CreateBindMessage(portal, statement string, parameters []byte) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(MessageTypeBind); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if _, err = message.WriteString(portal); err != nil {
+		return
+	}
+	if _, err = message.WriteString(statement); err != nil {
+		return
+	}
+	if _, err = message.WriteBytes(parameters); err != nil {
+		return
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
+
+/**
+ * Describe (F) and Close (F)
+ *
+ * Both messages name a prepared statement ('S') or a portal ('P').
+ */
+func CreateTargetMessage(messageType byte, target byte, name string) (_ []byte, err error) {
+	message := NewMessageBuffer()
+	if err = message.WriteByte(messageType); err != nil {
+		return
+	}
+	if _, err = message.WriteInt32(0); err != nil {
+		return
+	}
+	if err = message.WriteByte(target); err != nil {
+		return
+	}
+	if _, err = message.WriteString(name); err != nil {
+		return
+	}
+	message.ResetLength(PostgresMessageLengthOffset)
+	return message.Bytes(), nil
+}
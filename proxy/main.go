@@ -1,71 +1,170 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
 	"net"
-	"sync"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-type Connection struct {
-	ID string
-}
-
-type Proxy struct {
-	Connections []Connection
-	mux         sync.Mutex
-}
+// Version of the proxy, set at build time with -ldflags "-X main.Version=..."
+var Version = "devel"
 
 func init() {
 	log.SetFlags(log.LUTC | log.Lshortfile)
 }
 
 func main() {
-	listener, err := net.Listen("tcp", ":8989")
+	if len(os.Args) > 1 && os.Args[1] == "certs" {
+		os.Exit(RunCertsCommand(os.Args[2:]))
+	}
+	configFile := flag.String("config", DefaultConfigFile, "path to the proxy configuration file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	certificates, err := NewCertificateManager(config)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	go certificates.Watch()
+	tlsConfig, err := NewFrontendTLSConfig(config, certificates)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
+	certAuth, err := NewCertAuthenticator(config.CertAuth)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	metrics := NewMetrics()
+	pools := NewPoolManager(config, metrics)
+	health := NewHealthChecker(config)
+	health.OnChange = func(backend string, from, to string) {
+		if from == NodeStateUp {
+			// Sessions must not keep using a demoted or failed primary
+			pools.Drain(backend)
+		}
+	}
+	health.Start()
+	router := NewRouter(config, health)
+	replicas := NewReplicaSelector(config, health, pools)
+	cancels := NewCancelRegistry()
+	tracer, err := NewTracer(config.Tracing)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	sessions := NewSessionRegistry()
+	metrics.Sessions, metrics.Pools, metrics.Health, metrics.Certificates = sessions, pools, health, certificates
+	admin := NewAdminConsole(config, *configFile)
+	admin.Sessions, admin.Router, admin.Pools, admin.Certificates = sessions, router, pools, certificates
 
-	log.Println("listener is ready for connections at 8989")
-	for {
-		src, err := listener.Accept()
-		if err != nil {
+	// Take over the listeners of a running proxy being upgraded, if any
+	inherited, ready, err := InheritListeners(config.UpgradeSocket)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	var listener, httpListener net.Listener
+	if len(inherited) > 0 {
+		listener = inherited[0]
+	}
+	if len(inherited) > 1 {
+		httpListener = inherited[1]
+	}
+	if listener == nil {
+		if listener, err = net.Listen("tcp", config.Listen); err != nil {
 			log.Fatalf("%v", err)
 		}
-		log.Printf("new connection from psql client: %v", src.RemoteAddr().String())
-
+	}
+	if httpListener != nil && config.HTTPListen == "" {
+		_ = httpListener.Close()
+		httpListener = nil
+	}
+	if httpListener == nil && config.HTTPListen != "" {
+		if httpListener, err = net.Listen("tcp", config.HTTPListen); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	server := NewServer(listener, sessions, func(src net.Conn) *PostgresProxy {
+		return &PostgresProxy{
+			ReverseConnection: &PGConnection{
+				Conn: src,
+			},
+			socket:    src,
+			Config:    config,
+			Router:    router,
+			Pools:     pools,
+			Replicas:  replicas,
+			Cancels:   cancels,
+			Metrics:   metrics,
+			Tracer:    tracer,
+			Admin:     admin,
+			TLSConfig: tlsConfig,
+			CertAuth:  certAuth,
+			channelRecorder: &ChannelRecorder{
+				C: make(chan []byte, 2048),
+			},
+		}
+	})
+	httpServer := &http.Server{
+		Handler:           NewHTTPHandler(server, router, health, metrics),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if httpListener != nil {
 		go func() {
-			dst, err := net.Dial("tcp", "postgres:5432")
-			if err != nil {
-				log.Fatal(err)
+			if err := httpServer.Serve(httpListener); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("http: %v", err)
 			}
-
-			postgresProxy := PostgresProxy{
-				ForwardConnection: &PGConnection{
-					Conn:        dst,
-					username:    "postgres",
-					password:    "postgres",
-					database:    "postgres",
-					application: "psql",
-					C:           make(chan Packet, 2),
-					certFile:    "/opt/bin/proxy-crt.pem",
-					keyFile:     "/opt/bin/proxy-key.pem",
-				},
-				ReverseConnection: &PGConnection{
-					Conn:     src,
-					C:        make(chan Packet, 2),
-					certFile: "/opt/bin/proxy-crt.pem",
-					keyFile:  "/opt/bin/proxy-key.pem",
-				},
-				forwardChannel: make(chan struct{}, 2),
-				reverseChannel: make(chan struct{}, 2),
-				channelRecorder: ChannelRecorder{
-					C: make(chan []byte, 2048),
-				},
-			}
-
-			postgresProxy.Connect()
-
-			log.Printf("connected to postgres server at %v", dst.RemoteAddr().String())
 		}()
+		log.Printf("serving /metrics, /healthz and /readyz at http://%v", httpListener.Addr())
+	}
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	handedOff := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %v", sig)
+		case <-admin.ShutdownRequested():
+		case <-handedOff:
+			// The new process serves the HTTP endpoints from now on
+			_ = httpServer.Close()
+		}
+		// Sessions waiting on PAUSE finish their work while draining
+		pools.Resume()
+		server.Shutdown(config.ShutdownTimeout.Duration)
+		pools.Close()
+		tracer.Close()
+		close(stopped)
+	}()
+
+	if ready != nil {
+		if err := ready(); err != nil {
+			log.Fatalf("upgrade: %v", err)
+		}
+		log.Printf("upgrade: took over the listeners at %v", listener.Addr())
+	}
+	if config.UpgradeSocket != "" {
+		listeners := []net.Listener{listener}
+		if httpListener != nil {
+			listeners = append(listeners, httpListener)
+		}
+		if err := ServeUpgrades(config.UpgradeSocket, listeners, handedOff); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	go WatchUpgradeSignal(config.UpgradeSocket)
+	log.Printf("listener is ready for connections at %v", listener.Addr())
+	if err := server.Serve(); err != nil {
+		log.Fatalf("%v", err)
 	}
+	<-stopped
+	log.Printf("shutdown complete")
 }
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Admin console
+ *
+ * Clients connecting to admin.database (default "pgproxy") reach a console built into the proxy instead of
+ * a backend, like the pgbouncer database of PgBouncer. Only admin.users log in, with their password or with
+ * a client certificate mapped to their user name by cert_auth. The console speaks the simple query protocol:
+ *
+ *   SHOW CLIENTS    client sessions, by their id in the session registry
+ *   SHOW SERVERS    backend connections, idle in their pool or used by a client
+ *   SHOW POOLS      clients and connections per pool
+ *   SHOW STATS      query, traffic and wait totals per pool, times in microseconds
+ *   SHOW CONFIG     the running configuration, secrets masked
+ *   SHOW VERSION
+ *   SHOW HELP
+ *   PAUSE           hand out no more backend connections and wait until none is in use
+ *   RESUME          end PAUSE
+ *   RELOAD          read the configuration file again, see reload
+ *   KILL <id>       disconnect a client
+ *   SHUTDOWN        drain the sessions and exit, as on SIGTERM
+ */
+
+const consoleTimeFormat = "2006-01-02 15:04:05 MST"
+
+// How often PAUSE checks whether backend connections are still in use
+const pauseCheckInterval = 100 * time.Millisecond
+
+// Settings a RELOAD applies, changes to the others need a restart or an upgrade
+var reloadableSettings = map[string]bool{"routes": true, "default_route": true}
+
+const consoleHelp = `SHOW CLIENTS|SERVERS|POOLS|STATS|CONFIG|VERSION|HELP
+PAUSE
+RESUME
+RELOAD
+KILL <client id>
+SHUTDOWN`
+
+type AdminConsole struct {
+	config *Config
+	// Configuration file read again by RELOAD
+	configFile   string
+	Sessions     *SessionRegistry
+	Router       *Router
+	Pools        *PoolManager
+	Certificates *CertificateManager
+	reloading    sync.Mutex
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+func NewAdminConsole(config *Config, configFile string) *AdminConsole {
+	return &AdminConsole{
+		config:     config,
+		configFile: configFile,
+		shutdown:   make(chan struct{}),
+	}
+}
+
+// ShutdownRequested returns a channel closed once SHUTDOWN ran on the console.
+func (admin *AdminConsole) ShutdownRequested() <-chan struct{} {
+	return admin.shutdown
+}
+
+// handles reports whether a frontend asked for the console rather than a backend.
+func (admin *AdminConsole) handles(attributes map[string]string) bool {
+	return admin.config.Admin.Enabled() && NewRouteRequest(attributes, "").Database == admin.config.Admin.Database
+}
+
+// consoleResult answers a console command: notices, a result set when columns are set, and the command tag.
+type consoleResult struct {
+	notices []string
+	columns []string
+	rows    [][]string
+	tag     string
+}
+
+func consoleError(code, format string, args ...interface{}) error {
+	return &PostgresError{Severity: ErrorSeverityError, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+/**
+ * console serves a frontend connected to the admin database until it terminates.
+ *
+ * The session's transaction state follows the console's query cycles, so a shutdown drains it between commands.
+ * Extended query messages are answered with one error and skipped up to the next Sync.
+ */
+func (proxy *PostgresProxy) console() {
+	proxy.span.SetAttribute("pgproxy.admin", true)
+	if err := proxy.consoleHandshake(); err != nil {
+		proxy.handshakeFailed(HandshakeFailureAuthentication, err)
+		return
+	}
+	proxy.login()
+	frontend := proxy.ReverseConnection
+	log.Printf("admin: %v logged in to the console from %v, session %v", frontend.username,
+		frontend.Conn.RemoteAddr(), proxy.connection.ID)
+	proxy.pmutex.Lock()
+	proxy.state = NewTransactionState()
+	draining := proxy.draining
+	proxy.pmutex.Unlock()
+	if draining {
+		proxy.Terminate(adminShutdownMessage)
+		return
+	}
+
+	skipping := false
+	for {
+		packet := frontend.ReadMessage()
+		if packet.Error != nil {
+			log.Println(packet.Error)
+			return
+		}
+		proxy.state.Frontend(packet.Body)
+		var err error
+		switch GetMessageType(packet.Body) {
+		case MessageTypeTerminate:
+			return
+		case MessageTypeQuery:
+			query := GetQuery(packet.Body)
+			proxy.connection.Query(query)
+			if err = proxy.Admin.run(proxy, query); err == nil {
+				err = proxy.consoleReady()
+			}
+		case MessageTypeSync:
+			skipping = false
+			err = proxy.consoleReady()
+		case MessageTypeParse, MessageTypeBind, MessageTypeDescribe, MessageTypeExecute, MessageTypeClose,
+			MessageTypeFlush:
+			if !skipping {
+				skipping = true
+				err = frontend.sendErrorResponse(ErrorSeverityError, SQLStateFeatureNotSupported,
+					"the admin console only supports the simple query protocol")
+			}
+		default:
+			_ = frontend.sendErrorResponse(ErrorSeverityFatal, SQLStateProtocolViolation,
+				fmt.Sprintf("unexpected message type %q", GetMessageType(packet.Body)))
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if proxy.Draining() && proxy.state.Idle() {
+			proxy.Terminate(adminShutdownMessage)
+			return
+		}
+	}
+}
+
+// consoleHandshake authenticates a console user and completes the startup as a backend would.
+func (proxy *PostgresProxy) consoleHandshake() error {
+	frontend := proxy.ReverseConnection
+	password, ok := proxy.Config.Admin.Users[frontend.username]
+	if !ok {
+		err := fmt.Errorf("user %q may not use the admin console", frontend.username)
+		_ = frontend.sendErrorResponse(ErrorSeverityFatal, SQLStateInvalidAuthorization, err.Error())
+		return err
+	}
+	if proxy.identity == nil {
+		given, err := proxy.passwordHandshake()
+		if err != nil {
+			return err
+		}
+		if password == "" || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+			err := fmt.Errorf("password authentication failed for user %q", frontend.username)
+			_ = frontend.sendErrorResponse(ErrorSeverityFatal, SQLStateInvalidPassword, err.Error())
+			return err
+		}
+	}
+	if err := frontend.sendAuthenticationOKResponse(); err != nil {
+		return err
+	}
+	parameters := map[string]string{
+		"server_version":              Version + "/pgproxy",
+		"server_encoding":             "UTF8",
+		"client_encoding":             "UTF8",
+		"DateStyle":                   "ISO, MDY",
+		"integer_datetimes":           "on",
+		"standard_conforming_strings": "on",
+		"application_name":            frontend.application,
+	}
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := frontend.sendParameterStatus(name, parameters[name]); err != nil {
+			return err
+		}
+	}
+	if err := proxy.sendCancelKey(); err != nil {
+		return err
+	}
+	return frontend.sendReadyForQuery()
+}
+
+// consoleReady ends a query cycle of the console.
+func (proxy *PostgresProxy) consoleReady() error {
+	message, err := ReadyForQueryMessage()
+	if err != nil {
+		return err
+	}
+	if err := proxy.ReverseConnection.SendMessage(message).Error; err != nil {
+		return err
+	}
+	return proxy.state.Backend(message)
+}
+
+// run answers a query string, whose commands are separated by semicolons. It stops at the first failing command.
+func (admin *AdminConsole) run(proxy *PostgresProxy, query string) error {
+	frontend := proxy.ReverseConnection
+	var commands [][]string
+	for _, command := range strings.Split(query, ";") {
+		if words := strings.Fields(command); len(words) > 0 {
+			commands = append(commands, words)
+		}
+	}
+	if len(commands) == 0 {
+		message, err := CompleteMessage(MessageTypeEmptyQueryResponse)
+		if err != nil {
+			return err
+		}
+		return frontend.SendMessage(message).Error
+	}
+	for _, words := range commands {
+		result, err := admin.execute(proxy, words)
+		var perr *PostgresError
+		if errors.As(err, &perr) {
+			return frontend.sendErrorResponse(perr.Severity, perr.Code, perr.Message)
+		}
+		if err != nil {
+			return err
+		}
+		for _, notice := range result.notices {
+			if err := frontend.sendNoticeResponse(NoticeSeverityNotice, SQLStateSuccessfulCompletion, notice); err != nil {
+				return err
+			}
+		}
+		if result.columns != nil {
+			err = frontend.sendRows(result.columns, result.rows, result.tag)
+		} else {
+			err = frontend.sendCommandComplete(result.tag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (admin *AdminConsole) execute(proxy *PostgresProxy, words []string) (*consoleResult, error) {
+	command, args := strings.ToUpper(words[0]), words[1:]
+	if command == "SHOW" {
+		if len(args) != 1 {
+			return nil, consoleError(SQLStateSyntaxError, "SHOW takes one of CLIENTS, SERVERS, POOLS, STATS, CONFIG, VERSION, HELP")
+		}
+		switch strings.ToUpper(args[0]) {
+		case "CLIENTS":
+			return admin.showClients(), nil
+		case "SERVERS":
+			return admin.showServers(), nil
+		case "POOLS":
+			return admin.showPools(), nil
+		case "STATS":
+			return admin.showStats(), nil
+		case "CONFIG":
+			return admin.showConfig()
+		case "VERSION":
+			return &consoleResult{columns: []string{"version"}, rows: [][]string{{"pgproxy " + Version}}, tag: "SHOW"}, nil
+		case "HELP":
+			return &consoleResult{notices: []string{"Console usage\n" + consoleHelp}, tag: "SHOW"}, nil
+		}
+		return nil, consoleError(SQLStateSyntaxError, "unknown SHOW %v, see SHOW HELP", args[0])
+	}
+	if command == "KILL" {
+		if len(args) != 1 {
+			return nil, consoleError(SQLStateSyntaxError, "KILL takes a client id, see SHOW CLIENTS")
+		}
+		return admin.kill(proxy, args[0])
+	}
+	if len(args) > 0 {
+		return nil, consoleError(SQLStateSyntaxError, "%v takes no arguments", command)
+	}
+	switch command {
+	case "PAUSE":
+		return admin.pause(proxy)
+	case "RESUME":
+		return admin.resume(proxy)
+	case "RELOAD":
+		return admin.reload(proxy)
+	case "SHUTDOWN":
+		log.Printf("admin: %v requested a shutdown", proxy.ReverseConnection.username)
+		admin.shutdownOnce.Do(func() {
+			close(admin.shutdown)
+		})
+		return &consoleResult{tag: "SHUTDOWN"}, nil
+	}
+	return nil, consoleError(SQLStateSyntaxError, "unknown command %v, see SHOW HELP", words[0])
+}
+
+// pools returns the pools ordered by key.
+func (admin *AdminConsole) pools() []*Pool {
+	pools := admin.Pools.Pools()
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Key.String() < pools[j].Key.String()
+	})
+	return pools
+}
+
+func (admin *AdminConsole) showClients() *consoleResult {
+	result := &consoleResult{
+		columns: []string{"id", "user", "database", "application_name", "state", "addr", "port", "tls",
+			"server_name", "backend", "pool_mode", "server_pid", "connect_time", "bytes_received", "bytes_sent",
+			"query_time", "query"},
+		tag: "SHOW",
+	}
+	for _, client := range admin.Sessions.Info() {
+		host, port := splitAddr(client.ClientAddr)
+		var mode, serverPID, queryTime string
+		if client.pool != nil {
+			mode = client.pool.Mode()
+		}
+		if client.BackendPID != 0 {
+			serverPID = strconv.Itoa(int(client.BackendPID))
+		}
+		if !client.LastQueryAt.IsZero() {
+			queryTime = client.LastQueryAt.UTC().Format(consoleTimeFormat)
+		}
+		result.rows = append(result.rows, []string{client.ID, client.User, client.Database, client.ApplicationName,
+			client.State, host, port, client.TLS, client.ServerName, client.Backend, mode, serverPID,
+			client.Started.UTC().Format(consoleTimeFormat), strconv.FormatUint(client.BytesReceived, 10),
+			strconv.FormatUint(client.BytesSent, 10), queryTime, client.LastQuery})
+	}
+	return result
+}
+
+func (admin *AdminConsole) showServers() *consoleResult {
+	result := &consoleResult{
+		columns: []string{"backend", "database", "user", "state", "addr", "port", "remote_pid", "tls", "client_id",
+			"connect_time"},
+		tag: "SHOW",
+	}
+	row := func(pg *PGConnection, state, client string) []string {
+		host, port := splitAddr(pg.Conn.RemoteAddr())
+		key := pg.pool.Key
+		return []string{key.Backend, key.Database, key.User, state, host, port, strconv.Itoa(int(pg.processID)),
+			tlsVersion(pg.Conn), client, pg.createdAt.UTC().Format(consoleTimeFormat)}
+	}
+	used := make(map[*Pool][]ConnectionInfo)
+	for _, client := range admin.Sessions.Info() {
+		if client.server != nil {
+			used[client.server.pool] = append(used[client.server.pool], client)
+		}
+	}
+	for _, pool := range admin.pools() {
+		for _, client := range used[pool] {
+			result.rows = append(result.rows, row(client.server, "used", client.ID))
+		}
+		for _, pg := range pool.IdleConnections() {
+			result.rows = append(result.rows, row(pg, "idle", ""))
+		}
+	}
+	return result
+}
+
+func (admin *AdminConsole) showPools() *consoleResult {
+	result := &consoleResult{
+		columns: []string{"backend", "database", "user", "pool_mode", "cl_active", "cl_waiting", "sv_used", "sv_idle",
+			"max_size", "paused"},
+		tag: "SHOW",
+	}
+	clients := make(map[*Pool]int)
+	for _, client := range admin.Sessions.Info() {
+		if client.pool != nil {
+			clients[client.pool]++
+		}
+	}
+	paused := strconv.FormatBool(admin.Pools.Resumed() != nil)
+	for _, pool := range admin.pools() {
+		stats := pool.Stats()
+		result.rows = append(result.rows, []string{pool.Key.Backend, pool.Key.Database, pool.Key.User, pool.Mode(),
+			strconv.Itoa(clients[pool]), strconv.Itoa(stats.Waiting), strconv.Itoa(stats.Open - stats.Idle),
+			strconv.Itoa(stats.Idle), strconv.Itoa(pool.config.MaxSize), paused})
+	}
+	return result
+}
+
+func (admin *AdminConsole) showStats() *consoleResult {
+	result := &consoleResult{
+		columns: []string{"backend", "database", "user", "total_clients", "total_query_count", "total_query_time",
+			"avg_query_time", "total_received", "total_sent", "total_wait_count", "total_wait_time", "max_wait_time",
+			"total_wait_timeouts"},
+		tag: "SHOW",
+	}
+	micros := func(d time.Duration) string {
+		return strconv.FormatInt(d.Microseconds(), 10)
+	}
+	for _, pool := range admin.pools() {
+		metrics, stats := pool.metrics, pool.Stats()
+		queries := metrics.QueryDuration.Count()
+		queryTime := time.Duration(metrics.QueryDuration.Sum() * float64(time.Second))
+		var average time.Duration
+		if queries > 0 {
+			average = queryTime / time.Duration(queries)
+		}
+		result.rows = append(result.rows, []string{pool.Key.Backend, pool.Key.Database, pool.Key.User,
+			strconv.FormatUint(metrics.ClientsTotal.Value(), 10), strconv.FormatUint(queries, 10), micros(queryTime),
+			micros(average), strconv.FormatUint(metrics.BytesToBackend.Value(), 10),
+			strconv.FormatUint(metrics.BytesToFrontend.Value(), 10), strconv.FormatUint(stats.Waits, 10),
+			micros(stats.WaitTime), micros(stats.MaxWaitTime), strconv.FormatUint(stats.Timeouts, 10)})
+	}
+	return result
+}
+
+// showConfig lists the running settings by their JSON path, with the routes RELOAD may have replaced.
+func (admin *AdminConsole) showConfig() (*consoleResult, error) {
+	running := *admin.config
+	running.Routes, running.DefaultRoute = admin.Router.Routes()
+	data, err := json.Marshal(&running)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var settings interface{}
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, err
+	}
+	result := &consoleResult{columns: []string{"key", "value"}, tag: "SHOW"}
+	flattenSettings("", settings, &result.rows)
+	return result, nil
+}
+
+// flattenSettings adds a row per setting of a decoded JSON document, secrets masked.
+func flattenSettings(path string, value interface{}, rows *[][]string) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			*rows = append(*rows, []string{path, "{}"})
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flattenSettings(join(key), value[key], rows)
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			*rows = append(*rows, []string{path, "[]"})
+		}
+		for i, element := range value {
+			flattenSettings(join(strconv.Itoa(i)), element, rows)
+		}
+	case nil:
+		*rows = append(*rows, []string{path, ""})
+	default:
+		text := fmt.Sprint(value)
+		if text != "" && secretSetting(path) {
+			text = "********"
+		}
+		*rows = append(*rows, []string{path, text})
+	}
+}
+
+func secretSetting(path string) bool {
+	name := path[strings.LastIndex(path, ".")+1:]
+	return name == "password" || name == "backend_password" || strings.HasPrefix(path, "admin.users.") ||
+		strings.HasPrefix(path, "users.") ||
+		strings.HasPrefix(path, "tracing.headers.")
+}
+
+/**
+ * pause stops handing out backend connections and returns once none is in use.
+ *
+ * Clients keep their connections up to the end of their transaction in transaction mode, and up to the end
+ * of their session in session mode. A RESUME meanwhile ends the wait with an error.
+ */
+func (admin *AdminConsole) pause(proxy *PostgresProxy) (*consoleResult, error) {
+	if !admin.Pools.Pause() {
+		return nil, consoleError(SQLStateNotInPrerequisite, "the pools are paused already")
+	}
+	log.Printf("admin: %v paused the pools, %d backend connections in use", proxy.ReverseConnection.username,
+		admin.Pools.InUse(""))
+	ticker := time.NewTicker(pauseCheckInterval)
+	defer ticker.Stop()
+	for admin.Pools.InUse("") > 0 {
+		resumed := admin.Pools.Resumed()
+		if resumed == nil {
+			return nil, consoleError(SQLStateNotInPrerequisite, "the pools were resumed while pausing")
+		}
+		select {
+		case <-resumed:
+		case <-ticker.C:
+		}
+	}
+	return &consoleResult{tag: "PAUSE"}, nil
+}
+
+func (admin *AdminConsole) resume(proxy *PostgresProxy) (*consoleResult, error) {
+	if !admin.Pools.Resume() {
+		return nil, consoleError(SQLStateNotInPrerequisite, "the pools are not paused")
+	}
+	log.Printf("admin: %v resumed the pools", proxy.ReverseConnection.username)
+	return &consoleResult{tag: "RESUME"}, nil
+}
+
+/**
+ * reload reads the configuration file again and applies its routes, as long as they fit the running backends
+ * and clusters, and reloads the certificate files. Other changed settings are reported in notices:
+ * they take a restart or an upgrade to apply.
+ */
+func (admin *AdminConsole) reload(proxy *PostgresProxy) (*consoleResult, error) {
+	admin.reloading.Lock()
+	defer admin.reloading.Unlock()
+	loaded, err := LoadConfig(admin.configFile)
+	if err != nil {
+		return nil, consoleError(SQLStateConfigFileError, "%v", err)
+	}
+	running := *admin.config
+	running.Routes, running.DefaultRoute = loaded.Routes, loaded.DefaultRoute
+	if err := running.Validate(); err != nil {
+		return nil, consoleError(SQLStateConfigFileError, "routes of %v don't fit the running backends: %v",
+			admin.configFile, err)
+	}
+	changed, err := changedSettings(&running, loaded)
+	if err != nil {
+		return nil, err
+	}
+	admin.Router.Update(loaded.Routes, loaded.DefaultRoute)
+	result := &consoleResult{tag: "RELOAD"}
+	for _, setting := range changed {
+		result.notices = append(result.notices, fmt.Sprintf("%v changed, restart or upgrade the proxy to apply it", setting))
+	}
+	if err := admin.Certificates.Reload(); err != nil {
+		result.notices = append(result.notices, fmt.Sprintf("certificates: %v", err))
+	}
+	log.Printf("admin: %v reloaded %v", proxy.ReverseConnection.username, admin.configFile)
+	return result, nil
+}
+
+// changedSettings returns the top-level settings that differ between two configurations and RELOAD can't apply.
+func changedSettings(running, loaded *Config) (changed []string, err error) {
+	var before, after map[string]json.RawMessage
+	for _, c := range []struct {
+		config   *Config
+		settings *map[string]json.RawMessage
+	}{{running, &before}, {loaded, &after}} {
+		data, err := json.Marshal(c.config)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, c.settings); err != nil {
+			return nil, err
+		}
+	}
+	for setting, value := range after {
+		if !reloadableSettings[setting] && !bytes.Equal(value, before[setting]) {
+			changed = append(changed, setting)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// kill disconnects the client with the id SHOW CLIENTS reports.
+func (admin *AdminConsole) kill(proxy *PostgresProxy, id string) (*consoleResult, error) {
+	id = strings.ToLower(strings.Trim(id, "'"))
+	connection := admin.Sessions.Get(id)
+	if connection == nil {
+		return nil, consoleError(SQLStateUndefinedObject, "no client with id %q, see SHOW CLIENTS", id)
+	}
+	client := connection.Info()
+	log.Printf("admin: %v disconnected client %v, user %q database %q from %v", proxy.ReverseConnection.username,
+		client.ID, client.User, client.Database, client.ClientAddr)
+	connection.Session().Terminate(adminShutdownMessage)
+	return &consoleResult{tag: "KILL"}, nil
+}
+
+func splitAddr(addr net.Addr) (host, port string) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), ""
+	}
+	return host, port
+}
+
+// tlsVersion names the TLS version of a connection, empty for plaintext connections.
+func tlsVersion(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	version := tlsConn.ConnectionState().Version
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLSv" + name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
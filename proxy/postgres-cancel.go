@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+ * Query cancellation
+ *
+ * Frontends get a cancel key from the proxy, not the key of a backend: in transaction mode a session uses many
+ * backends over its lifetime, and backends are shared. A CancelRequest carrying a session's key is forwarded,
+ * with the backend's own key, to the backend the session is attached to at that moment. Sessions that are not
+ * attached to a backend run no query, so there is nothing to cancel.
+ *
+ * Keys are as long as the frontend's protocol version allows: 4 bytes in 3.0, 32 bytes in 3.2. As the proxy
+ * translates keys anyway, a 3.2 frontend can cancel queries on a 3.0 backend and the reverse.
+ */
+
+const CancelRequestTimeout = 5 * time.Second
+
+// errCancelRequestHandled ends a frontend connection that was opened to send a CancelRequest.
+var errCancelRequestHandled = errors.New("cancel request handled")
+
+// Length of the secret keys sent to protocol 3.2 frontends, as PostgreSQL 18 does
+const CancelKeyLength32 = 32
+
+// CancelKey is the process ID and secret key a frontend received in BackendKeyData.
+type CancelKey struct {
+	ProcessID int32
+	// Variable length since protocol 3.2, so a string to be usable as a map key
+	SecretKey string
+}
+
+type CancelRegistry struct {
+	mutex    sync.Mutex
+	sessions map[CancelKey]*PostgresProxy
+}
+
+func NewCancelRegistry() *CancelRegistry {
+	return &CancelRegistry{sessions: make(map[CancelKey]*PostgresProxy)}
+}
+
+// Register assigns a session a new, unique cancel key with a secret of the given length.
+func (registry *CancelRegistry) Register(proxy *PostgresProxy, length int) (CancelKey, error) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	for {
+		random := make([]byte, 4+length)
+		if _, err := rand.Read(random); err != nil {
+			return CancelKey{}, err
+		}
+		key := CancelKey{
+			// Process IDs are positive
+			ProcessID: int32(binary.BigEndian.Uint32(random[:4]) >> 1),
+			SecretKey: string(random[4:]),
+		}
+		if _, ok := registry.sessions[key]; !ok && key.ProcessID != 0 {
+			registry.sessions[key] = proxy
+			return key, nil
+		}
+	}
+}
+
+func (registry *CancelRegistry) Unregister(key CancelKey) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	delete(registry.sessions, key)
+}
+
+func (registry *CancelRegistry) session(key CancelKey) *PostgresProxy {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.sessions[key]
+}
+
+/**
+ * cancelRequest forwards the CancelRequest of a frontend to the backend its session is attached to.
+ *
+ * The session stays locked until the request is sent, so the backend can't be detached and attached to another
+ * session in between, whose query would be cancelled instead.
+ * As in PostgreSQL, the frontend gets no response either way, and unknown keys are only logged.
+ */
+func (proxy *PostgresProxy) cancelRequest(msg []byte) error {
+	processID, secretKey, err := GetCancelRequest(msg)
+	if err != nil {
+		return err
+	}
+	session := proxy.Cancels.session(CancelKey{ProcessID: processID, SecretKey: string(secretKey)})
+	if session == nil {
+		log.Printf("cancel request from %v for an unknown session", proxy.ReverseConnection.Conn.RemoteAddr())
+		return errCancelRequestHandled
+	}
+	session.pmutex.Lock()
+	defer session.pmutex.Unlock()
+	pg := session.ForwardConnection
+	if pg == nil {
+		return errCancelRequestHandled
+	}
+	if err := pg.Cancel(); err != nil {
+		log.Printf("cancel request for backend %v: %v", pg.backend.Address, err)
+	}
+	return errCancelRequestHandled
+}
+
+/**
+ * Cancel asks the backend to cancel the query running on this connection.
+ *
+ * The request goes over a new connection, which uses SSL when this one does.
+ */
+func (pg *PGConnection) Cancel() error {
+	address := pg.backend.Address
+	conn, err := net.DialTimeout("tcp", address, CancelRequestTimeout)
+	if err != nil {
+		return err
+	}
+	cancel := &PGConnection{Conn: conn, backend: pg.backend}
+	defer func() {
+		_ = cancel.Conn.Close()
+	}()
+	if err := conn.SetDeadline(time.Now().Add(CancelRequestTimeout)); err != nil {
+		return err
+	}
+	// Use SSL when the connection being cancelled does
+	if _, ok := pg.Conn.(*tls.Conn); ok {
+		if pg.backend.SSLNegotiation == SSLNegotiationDirect {
+			err = cancel.upgradeClient(address)
+		} else {
+			err = cancel.negotiateSSL(address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := cancel.sendCancelRequest(pg.processID, pg.secretKey); err != nil {
+		return fmt.Errorf("%v: %w", address, err)
+	}
+	return nil
+}
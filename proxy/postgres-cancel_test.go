@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCancelRegistry(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+	}{
+		{name: "protocol 3.0", length: 4},
+		{name: "protocol 3.2", length: CancelKeyLength32},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := NewCancelRegistry()
+			sessions := make(map[CancelKey]*PostgresProxy)
+			for i := 0; i < 1000; i++ {
+				session := &PostgresProxy{}
+				key, err := registry.Register(session, test.length)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if key.ProcessID <= 0 {
+					t.Fatalf("process ID %d is not positive", key.ProcessID)
+				}
+				if len(key.SecretKey) != test.length {
+					t.Fatalf("secret key of %d bytes, want %d", len(key.SecretKey), test.length)
+				}
+				if _, ok := sessions[key]; ok {
+					t.Fatalf("key %v registered twice", key)
+				}
+				sessions[key] = session
+			}
+			for key, session := range sessions {
+				if registry.session(key) != session {
+					t.Fatalf("key %v doesn't find its session", key)
+				}
+				other := key
+				other.SecretKey = key.SecretKey[:len(key.SecretKey)-1] + string(key.SecretKey[len(key.SecretKey)-1]^1)
+				if registry.session(other) != nil {
+					t.Fatalf("key %v with another secret finds a session", key)
+				}
+				registry.Unregister(key)
+				if registry.session(key) != nil {
+					t.Fatalf("key %v finds a session after Unregister", key)
+				}
+			}
+		})
+	}
+}
+
+func TestCancelRequestWithoutBackend(t *testing.T) {
+	registry := NewCancelRegistry()
+	session := &PostgresProxy{}
+	key, err := registry.Register(session, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	proxy := &PostgresProxy{Cancels: registry, ReverseConnection: &PGConnection{Conn: server}}
+	tests := []struct {
+		name      string
+		processID int32
+		secretKey []byte
+	}{
+		{name: "unknown session", processID: key.ProcessID + 1, secretKey: []byte(key.SecretKey)},
+		{name: "session not attached to a backend", processID: key.ProcessID, secretKey: []byte(key.SecretKey)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := CancelRequestMessage(test.processID, test.secretKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := proxy.cancelRequest(msg); !errors.Is(err, errCancelRequestHandled) {
+				t.Errorf("cancelRequest() = %v, want %v", err, errCancelRequestHandled)
+			}
+		})
+	}
+	if err := proxy.cancelRequest([]byte{0, 0, 0, 12, 4, 210, 22, 46, 0, 0, 0}); errors.Is(err, errCancelRequestHandled) || err == nil {
+		t.Errorf("cancelRequest() of a truncated message = %v, want an error", err)
+	}
+}
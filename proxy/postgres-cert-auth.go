@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/**
+ * Certificate authentication
+ *
+ * Like the cert method of pg_hba.conf, a client presenting a verified certificate is authenticated
+ * by the certificate alone and is not asked for a password. The certificate identity (the CN or a SAN)
+ * is mapped to the database users it may log in as by rules similar to pg_ident.conf: the first rule
+ * whose regular expression matches the identity and whose user (after \1 substitution) equals
+ * the requested user admits the client. A rule can also replace the backend credentials of the route.
+ *
+ * Clients without a certificate log in with their password from users, and the backend login is the route's.
+ * Users that must not log in that way are covered by require, globally or for the user of a rule.
+ */
+
+const (
+	CertIdentityCommonName = "cn"
+	CertIdentitySAN        = "san"
+)
+
+var ErrCertificateAuthentication = errors.New("certificate authentication failed")
+
+var identityGroupPattern = regexp.MustCompile(`\\(\d)`)
+
+type IdentityMapping struct {
+	pattern *regexp.Regexp
+	config  *IdentityMappingConfig
+}
+
+type CertAuthenticator struct {
+	identity string
+	mappings []*IdentityMapping
+	require  bool
+}
+
+func NewCertAuthenticator(config CertAuthConfig) (*CertAuthenticator, error) {
+	authenticator := &CertAuthenticator{identity: config.Identity, require: config.Require}
+	for _, mapping := range config.Map {
+		pattern, err := regexp.Compile(mapping.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("cert_auth: %w", err)
+		}
+		authenticator.mappings = append(authenticator.mappings, &IdentityMapping{pattern: pattern, config: mapping})
+	}
+	return authenticator, nil
+}
+
+// Enabled reports whether certificate authentication is configured.
+func (authenticator *CertAuthenticator) Enabled() bool {
+	return authenticator != nil && len(authenticator.mappings) > 0
+}
+
+// Required reports whether a user may only log in with a certificate mapped to it.
+func (authenticator *CertAuthenticator) Required(user string) bool {
+	if authenticator.require {
+		return true
+	}
+	for _, mapping := range authenticator.mappings {
+		if mapping.config.Require && mapping.config.User == user {
+			return true
+		}
+	}
+	return false
+}
+
+// identities returns the names a certificate is known by.
+func (authenticator *CertAuthenticator) identities(crt *x509.Certificate) (identities []string) {
+	if authenticator.identity != CertIdentitySAN {
+		return []string{crt.Subject.CommonName}
+	}
+	identities = append(identities, crt.DNSNames...)
+	identities = append(identities, crt.EmailAddresses...)
+	for _, uri := range crt.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
+
+/**
+ * Authenticate returns the mapping that admits a client certificate as a database user.
+ *
+ * It returns nil without error when the client sent no certificate, so the client falls back to the password.
+ */
+func (authenticator *CertAuthenticator) Authenticate(state tls.ConnectionState, user string) (*IdentityMappingConfig, error) {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	identities := authenticator.identities(state.PeerCertificates[0])
+	for _, mapping := range authenticator.mappings {
+		for _, identity := range identities {
+			match := mapping.pattern.FindStringSubmatchIndex(identity)
+			if match == nil {
+				continue
+			}
+			template := identityGroupPattern.ReplaceAllString(mapping.config.User, "$${$1}")
+			if string(mapping.pattern.ExpandString(nil, template, identity, match)) == user {
+				return mapping.config, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w for user %q: certificate identity %v is not mapped to it", ErrCertificateAuthentication,
+		user, strings.Join(identities, ", "))
+}
+
+/**
+ * authenticateCertificate authenticates the frontend by its client certificate, when it sent one.
+ *
+ * A client whose certificate doesn't map to the requested user is rejected with SQLSTATE 28000,
+ * as is a client without a certificate whose user requires one.
+ */
+func (proxy *PostgresProxy) authenticateCertificate() error {
+	if !proxy.CertAuth.Enabled() {
+		return nil
+	}
+	var state tls.ConnectionState
+	if conn, ok := proxy.ReverseConnection.Conn.(*tls.Conn); ok {
+		state = conn.ConnectionState()
+	}
+	user := proxy.ReverseConnection.username
+	mapping, err := proxy.CertAuth.Authenticate(state, user)
+	if err == nil && mapping == nil && proxy.CertAuth.Required(user) {
+		err = fmt.Errorf("%w for user %q: a client certificate is required", ErrCertificateAuthentication, user)
+	}
+	if err != nil {
+		_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateInvalidAuthorization, err.Error())
+		return err
+	}
+	proxy.identity = mapping
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+ * Certificate manager
+ *
+ * Keeps the TLS material of both legs in memory: the proxy's server certificate and client CA, and the
+ * root certificates and client certificates of the backends. The files are checked every
+ * tls.reload_interval; when any of them changed, all material is loaded and validated again and swapped
+ * in at once. New handshakes use the new material, established sessions keep theirs. Material that fails
+ * validation (unreadable, mismatched key, expired) is rejected and the previous material stays in use.
+ *
+ * Without cert_file and key_file, the proxy serves an ephemeral self-signed certificate generated at startup.
+ * Clients whose SNI server name matches one of tls.certificates are served that certificate instead.
+ */
+
+const (
+	DefaultCertificateReloadInterval = 30 * time.Second
+	DefaultCertificateExpiryWarning  = 7 * 24 * time.Hour
+)
+
+type sniCertificate struct {
+	serverName  string
+	certificate *tls.Certificate
+}
+
+type backendMaterial struct {
+	rootCAs     *x509.CertPool
+	certificate *tls.Certificate
+}
+
+// certificateMaterial is one consistent generation of all TLS material.
+type certificateMaterial struct {
+	server    *tls.Certificate
+	sni       []sniCertificate
+	clientCAs *x509.CertPool
+	backends  map[*BackendConfig]*backendMaterial
+	// Expiry of every certificate file, by path
+	expiry map[string]time.Time
+	// Digest of every file the material was loaded from, by path
+	digests map[string][32]byte
+}
+
+type CertificateManager struct {
+	config   *Config
+	mutex    sync.RWMutex
+	material *certificateMaterial
+	// Self-signed server certificate used when cert_file and key_file are empty
+	ephemeral *tls.Certificate
+	// Serializes the reloads of the watcher and the admin console
+	reloading sync.Mutex
+	// Last reload error and the expiry warnings already logged, so the watcher logs each once
+	lastError string
+	warned    map[string]time.Time
+}
+
+// NewCertificateManager loads the TLS material, failing if any of it is invalid.
+func NewCertificateManager(config *Config) (*CertificateManager, error) {
+	manager := &CertificateManager{config: config, warned: make(map[string]time.Time)}
+	if config.TLS.Mode != FrontendSSLDisable && config.CertFile == "" && config.KeyFile == "" {
+		ephemeral, err := EphemeralCertificate()
+		if err != nil {
+			return nil, err
+		}
+		manager.ephemeral = ephemeral
+		log.Printf("certificates: no cert_file configured, serving an ephemeral self-signed certificate (sha256 %x)",
+			sha256.Sum256(ephemeral.Certificate[0]))
+	}
+	material, err := manager.load()
+	if err != nil {
+		return nil, err
+	}
+	manager.material = material
+	for _, backend := range config.Backends {
+		backend.certificates = manager
+	}
+	manager.warnExpiry(material)
+	return manager, nil
+}
+
+// Watch reloads the material whenever one of its files changes.
+func (manager *CertificateManager) Watch() {
+	interval := manager.config.TLS.ReloadInterval.Duration
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		manager.reloading.Lock()
+		if !manager.changed() {
+			manager.warnExpiry(manager.current())
+		} else if err := manager.reload(); err != nil && err.Error() != manager.lastError {
+			log.Printf("certificates: %v", err)
+			manager.lastError = err.Error()
+		}
+		manager.reloading.Unlock()
+	}
+}
+
+// Reload loads the certificate files now, the current material stays in use when the new one is invalid.
+func (manager *CertificateManager) Reload() error {
+	manager.reloading.Lock()
+	defer manager.reloading.Unlock()
+	return manager.reload()
+}
+
+func (manager *CertificateManager) reload() error {
+	material, err := manager.load()
+	if err != nil {
+		return fmt.Errorf("keeping the current certificates, new material is invalid: %w", err)
+	}
+	manager.lastError = ""
+	manager.mutex.Lock()
+	manager.material = material
+	manager.mutex.Unlock()
+	log.Printf("certificates: reloaded")
+	manager.warnExpiry(material)
+	return nil
+}
+
+func (manager *CertificateManager) current() *certificateMaterial {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	return manager.material
+}
+
+// changed reports whether a file differs from the loaded material. Unreadable files count as unchanged.
+func (manager *CertificateManager) changed() bool {
+	for file, digest := range manager.current().digests {
+		data, err := os.ReadFile(file)
+		if err == nil && sha256.Sum256(data) != digest {
+			return true
+		}
+	}
+	return false
+}
+
+func (manager *CertificateManager) load() (*certificateMaterial, error) {
+	material := &certificateMaterial{
+		backends: make(map[*BackendConfig]*backendMaterial),
+		expiry:   make(map[string]time.Time),
+		digests:  make(map[string][32]byte),
+	}
+	var err error
+	if manager.ephemeral != nil {
+		material.server = manager.ephemeral
+	} else if manager.config.TLS.Mode != FrontendSSLDisable {
+		if material.server, err = material.keyPair(manager.config.CertFile, manager.config.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, config := range manager.config.TLS.Certificates {
+		crt, err := material.keyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		material.sni = append(material.sni, sniCertificate{serverName: config.ServerName, certificate: crt})
+	}
+	if manager.config.TLS.ClientCA != "" {
+		if material.clientCAs, err = material.certPool(manager.config.TLS.ClientCA); err != nil {
+			return nil, err
+		}
+	}
+	for _, backend := range manager.config.Backends {
+		loaded := &backendMaterial{}
+		switch backend.SSLRootCert {
+		case "":
+		case SSLRootCertSystem:
+			if loaded.rootCAs, err = x509.SystemCertPool(); err != nil {
+				return nil, err
+			}
+		default:
+			if loaded.rootCAs, err = material.certPool(backend.SSLRootCert); err != nil {
+				return nil, err
+			}
+		}
+		if backend.SSLCert != "" {
+			if loaded.certificate, err = material.keyPair(backend.SSLCert, backend.SSLKey); err != nil {
+				return nil, err
+			}
+		}
+		material.backends[backend] = loaded
+	}
+	return material, nil
+}
+
+func (material *certificateMaterial) read(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	material.digests[file] = sha256.Sum256(data)
+	return data, nil
+}
+
+// keyPair loads a certificate and its key, and checks that the certificate is currently valid.
+func (material *certificateMaterial) keyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	certPEM, err := material.read(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := material.read(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", certFile, err)
+	}
+	if crt.Leaf == nil {
+		if crt.Leaf, err = x509.ParseCertificate(crt.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("%v: %w", certFile, err)
+		}
+	}
+	now := time.Now()
+	if now.After(crt.Leaf.NotAfter) {
+		return nil, fmt.Errorf("%v: certificate expired on %v", certFile, crt.Leaf.NotAfter)
+	}
+	if now.Before(crt.Leaf.NotBefore) {
+		return nil, fmt.Errorf("%v: certificate is not valid before %v", certFile, crt.Leaf.NotBefore)
+	}
+	material.expiry[certFile] = crt.Leaf.NotAfter
+	return &crt, nil
+}
+
+func (material *certificateMaterial) certPool(file string) (*x509.CertPool, error) {
+	data, err := material.read(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %v", file)
+	}
+	return pool, nil
+}
+
+// warnExpiry logs certificates entering the expiry_warning window, once per certificate.
+func (manager *CertificateManager) warnExpiry(material *certificateMaterial) {
+	warning := manager.config.TLS.ExpiryWarning.Duration
+	for file, notAfter := range material.expiry {
+		remaining := time.Until(notAfter)
+		if remaining >= warning || manager.warned[file].Equal(notAfter) {
+			continue
+		}
+		manager.warned[file] = notAfter
+		log.Printf("certificates: %v expires in %v (%v)", file, remaining.Round(time.Minute), notAfter)
+	}
+}
+
+// ServerCertificate returns the current certificate of the proxy for an SNI server name, which may be empty.
+func (manager *CertificateManager) ServerCertificate(serverName string) (*tls.Certificate, error) {
+	material := manager.current()
+	if serverName != "" {
+		for _, sni := range material.sni {
+			if matchServerName(sni.serverName, serverName) {
+				return sni.certificate, nil
+			}
+		}
+	}
+	if server := material.server; server != nil {
+		return server, nil
+	}
+	return nil, errors.New("no server certificate loaded")
+}
+
+// ClientCAs returns the current pool client certificates are verified against.
+func (manager *CertificateManager) ClientCAs() *x509.CertPool {
+	return manager.current().clientCAs
+}
+
+// Backend returns the current root certificates and client certificate for a backend.
+func (manager *CertificateManager) Backend(backend *BackendConfig) (rootCAs *x509.CertPool, certificate *tls.Certificate) {
+	if loaded, ok := manager.current().backends[backend]; ok {
+		return loaded.rootCAs, loaded.certificate
+	}
+	return nil, nil
+}
+
+// CertificateExpiry is the expiry of a loaded certificate file.
+type CertificateExpiry struct {
+	File     string
+	NotAfter time.Time
+}
+
+// Expiry returns the expiry of every loaded certificate, by file name.
+func (manager *CertificateManager) Expiry() (expiry []CertificateExpiry) {
+	for file, notAfter := range manager.current().expiry {
+		expiry = append(expiry, CertificateExpiry{File: file, NotAfter: notAfter})
+	}
+	sort.Slice(expiry, func(i, j int) bool { return expiry[i].File < expiry[j].File })
+	return expiry
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/**
+ * proxy certs
+ *
+ * Certificate authority tooling for development and test deployments, so environments don't share
+ * committed keys:
+ *
+ *   proxy certs ca    -dir DIR                       creates DIR/ca-crt.pem and DIR/ca-key.pem
+ *   proxy certs issue -dir DIR -name NAME -san ...   issues DIR/NAME-crt.pem and DIR/NAME-key.pem
+ *   proxy certs dev   -dir DIR                       a CA plus proxy, postgres and psql certificates
+ *
+ * Certificates are written as PEM, private keys with mode 0600.
+ */
+
+const (
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeRSA     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+const (
+	CertificateUsageServer = "server"
+	CertificateUsageClient = "client"
+)
+
+const certsUsage = `usage: proxy certs <command> [flags]
+
+commands:
+  ca      create a certificate authority
+  issue   issue a certificate signed by the CA
+  dev     create a CA and certificates for the proxy, postgres and psql`
+
+// CertificateRequest describes a certificate to generate.
+type CertificateRequest struct {
+	CommonName string
+	// DNS names and IP addresses
+	SANs     []string
+	Usage    string
+	KeyType  string
+	Validity time.Duration
+	IsCA     bool
+}
+
+// RunCertsCommand runs "proxy certs" with its arguments and returns the exit code.
+func RunCertsCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, certsUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "ca":
+		err = certsCA(args[1:])
+	case "issue":
+		err = certsIssue(args[1:])
+	case "dev":
+		err = certsDev(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, certsUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "proxy certs %v: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func certsCA(args []string) error {
+	flags := flag.NewFlagSet("certs ca", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "output directory")
+	commonName := flags.String("cn", "postgres-proxy development CA", "common name")
+	days := flags.Int("days", 3650, "validity in days")
+	keyType := flags.String("key", KeyTypeECDSA, "key type: ecdsa, rsa or ed25519")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	crt, key, err := GenerateCertificate(CertificateRequest{
+		CommonName: *commonName,
+		KeyType:    *keyType,
+		Validity:   time.Duration(*days) * 24 * time.Hour,
+		IsCA:       true,
+	}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(*dir, "ca", crt, key)
+}
+
+func certsIssue(args []string) error {
+	flags := flag.NewFlagSet("certs issue", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "output directory")
+	caDir := flags.String("ca-dir", "", "directory of ca-crt.pem and ca-key.pem (default: -dir)")
+	name := flags.String("name", "", "file name prefix, e.g. proxy writes proxy-crt.pem and proxy-key.pem")
+	commonName := flags.String("cn", "", "common name (default: -name)")
+	sans := flags.String("san", "", "comma separated DNS names and IP addresses")
+	usage := flags.String("usage", CertificateUsageServer, "server or client")
+	days := flags.Int("days", 365, "validity in days")
+	keyType := flags.String("key", KeyTypeECDSA, "key type: ecdsa, rsa or ed25519")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	if *caDir == "" {
+		*caDir = *dir
+	}
+	if *commonName == "" {
+		*commonName = *name
+	}
+	ca, err := tls.LoadX509KeyPair(filepath.Join(*caDir, "ca-crt.pem"), filepath.Join(*caDir, "ca-key.pem"))
+	if err != nil {
+		return err
+	}
+	caCrt, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+	request := CertificateRequest{
+		CommonName: *commonName,
+		Usage:      *usage,
+		KeyType:    *keyType,
+		Validity:   time.Duration(*days) * 24 * time.Hour,
+	}
+	if *sans != "" {
+		request.SANs = strings.Split(*sans, ",")
+	}
+	crt, key, err := GenerateCertificate(request, caCrt, ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(*dir, *name, crt, key)
+}
+
+// certsDev lays out the certificates of the docker-compose setup.
+func certsDev(args []string) error {
+	flags := flag.NewFlagSet("certs dev", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "output directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := certsCA([]string{"-dir", *dir}); err != nil {
+		return err
+	}
+	issues := [][]string{
+		{"-name", "proxy", "-san", "localhost,proxy,127.0.0.1"},
+		{"-name", "postgres", "-san", "localhost,postgres,127.0.0.1"},
+		{"-name", "psql", "-cn", "postgres", "-usage", CertificateUsageClient},
+	}
+	for _, issue := range issues {
+		if err := certsIssue(append([]string{"-dir", *dir}, issue...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateCertificate creates a key and a certificate, self-signed when ca is nil.
+func GenerateCertificate(request CertificateRequest, ca *x509.Certificate, caKey crypto.PrivateKey) (*x509.Certificate, crypto.Signer, error) {
+	key, err := generateKey(request.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: request.CommonName},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(request.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	switch {
+	case request.IsCA:
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	case request.Usage == CertificateUsageClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case request.Usage == CertificateUsageServer:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	default:
+		return nil, nil, fmt.Errorf("unknown usage %q", request.Usage)
+	}
+	for _, san := range request.SANs {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+	parent, signer := template, crypto.PrivateKey(key)
+	if ca != nil {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return crt, key, nil
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSA, "":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type %q", keyType)
+}
+
+func writeKeyPair(dir, name string, crt *x509.Certificate, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	crtFile, keyFile := filepath.Join(dir, name+"-crt.pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw}), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %v and %v (%v, expires %v)\n", crtFile, keyFile, crt.Subject.CommonName, crt.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// EphemeralCertificate creates an in-memory self-signed server certificate for the proxy.
+func EphemeralCertificate() (*tls.Certificate, error) {
+	hostname, _ := os.Hostname()
+	sans := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname != "" {
+		sans = append(sans, hostname)
+	}
+	crt, key, err := GenerateCertificate(CertificateRequest{
+		CommonName: "postgres-proxy ephemeral",
+		SANs:       sans,
+		Usage:      CertificateUsageServer,
+		Validity:   365 * 24 * time.Hour,
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{crt.Raw}, PrivateKey: key, Leaf: crt}, nil
+}
@@ -7,19 +7,25 @@ import (
 )
 
 type ChannelRecorder struct {
-	C         chan []byte
-	closeOnce sync.Once
+	C      chan []byte
+	mutex  sync.Mutex
+	closed bool
 }
 
-func (cr ChannelRecorder) Write(data []byte) (int, error) {
-	go func() {
-		cr.C <- data
-	}()
-
+// Write hands the data to the watcher without blocking the transfer; data is dropped when the watcher falls behind.
+func (cr *ChannelRecorder) Write(data []byte) (int, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if !cr.closed {
+		select {
+		case cr.C <- data:
+		default:
+		}
+	}
 	return len(data), nil
 }
 
-func (cr ChannelRecorder) Watch() {
+func (cr *ChannelRecorder) Watch() {
 	for {
 		select {
 		case data, ok := <-cr.C:
@@ -32,8 +38,11 @@ func (cr ChannelRecorder) Watch() {
 	}
 }
 
-func (cr ChannelRecorder) Close() {
-	cr.closeOnce.Do(func() {
+func (cr *ChannelRecorder) Close() {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if !cr.closed {
+		cr.closed = true
 		close(cr.C)
-	})
+	}
 }
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+ * Proxy configuration
+ *
+ * The configuration is read from a JSON file at startup. When the file does not exist
+ * the proxy falls back to DefaultConfig, which fronts a single postgres backend.
+ */
+
+const (
+	DefaultConfigFile        = "/opt/bin/proxy.json"
+	DefaultListenAddress     = ":8989"
+	DefaultHTTPListenAddress = ":8990"
+	DefaultAdminDatabase     = "pgproxy"
+	DefaultMaxPools          = 1000
+)
+
+type Config struct {
+	Listen       string                    `json:"listen"`
+	CertFile     string                    `json:"cert_file"`
+	KeyFile      string                    `json:"key_file"`
+	Backends     map[string]*BackendConfig `json:"backends"`
+	Clusters     map[string]*ClusterConfig `json:"clusters"`
+	Routes       []*RouteConfig            `json:"routes"`
+	DefaultRoute *RouteConfig              `json:"default_route"`
+	Pool         PoolConfig                `json:"pool"`
+	HealthCheck  HealthCheckConfig         `json:"health_check"`
+	TLS          FrontendTLSConfig         `json:"tls"`
+	CertAuth     CertAuthConfig            `json:"cert_auth"`
+	Tracing      TracingConfig             `json:"tracing"`
+	Admin        AdminConfig               `json:"admin"`
+	// Upper bound of the pools, one per (backend, user, database); clients needing another one get SQLSTATE 53300
+	MaxPools int `json:"max_pools"`
+	// Passwords of the client users by user name. Clients not authenticated by their certificate log in with these.
+	Users map[string]string `json:"users"`
+	// How long clients in a transaction may finish it after SIGTERM, before they are disconnected
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Unix socket the listeners are handed over on to a new proxy process during upgrades, empty disables upgrades
+	UpgradeSocket string `json:"upgrade_socket"`
+	// Address of the HTTP server for /metrics, empty disables it
+	HTTPListen string `json:"http_listen"`
+	// Run-time parameters replayed when a pooled client moves to another backend connection
+	TrackParameters []string `json:"track_parameters"`
+}
+
+// BackendConfig describes a named postgres cluster and the credentials the proxy uses to log in to it.
+type BackendConfig struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// SSL of the connections to the backend, with the meaning of the libpq options of the same name.
+	// Unset options are taken from PGSSLMODE, PGSSLROOTCERT, PGSSLCERT and PGSSLKEY, sslmode defaults to "prefer".
+	SSLMode     string `json:"sslmode"`
+	SSLRootCert string `json:"sslrootcert"`
+	SSLCert     string `json:"sslcert"`
+	SSLKey      string `json:"sslkey"`
+	// "postgres" (default) sends an SSLRequest first, "direct" starts TLS at once (PostgreSQL 17 and later).
+	// Taken from PGSSLNEGOTIATION when unset.
+	SSLNegotiation string `json:"sslnegotiation"`
+	// Newest protocol version requested from the backend: "3.0" (default), "3.2" or "latest", as the libpq option.
+	// Taken from PGMAXPROTOCOLVERSION when unset.
+	MaxProtocolVersion string `json:"max_protocol_version"`
+	// Overrides settings of the global pool for this backend, the settings it leaves out are the global ones
+	Pool json.RawMessage `json:"pool"`
+	// Pool settings of the backend, set up by LoadConfig
+	pool *PoolConfig
+	// TLS material of the backend, set up by NewCertificateManager
+	certificates *CertificateManager
+}
+
+const (
+	SSLModeDisable    = "disable"
+	SSLModeAllow      = "allow"
+	SSLModePrefer     = "prefer"
+	SSLModeRequire    = "require"
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
+	// sslrootcert value selecting the system's trusted CAs
+	SSLRootCertSystem = "system"
+)
+
+const (
+	SSLNegotiationPostgres = "postgres"
+	SSLNegotiationDirect   = "direct"
+)
+
+var protocolVersions = map[string]int32{
+	"3.0":    ProtocolVersion,
+	"3.2":    ProtocolVersion32,
+	"latest": ProtocolVersionLatest,
+}
+
+// setLibpqDefaults fills the libpq options left unset from the libpq environment variables.
+func (backend *BackendConfig) setLibpqDefaults() {
+	defaults := []struct {
+		option   *string
+		variable string
+	}{
+		{&backend.SSLMode, "PGSSLMODE"},
+		{&backend.SSLRootCert, "PGSSLROOTCERT"},
+		{&backend.SSLCert, "PGSSLCERT"},
+		{&backend.SSLKey, "PGSSLKEY"},
+		{&backend.SSLNegotiation, "PGSSLNEGOTIATION"},
+		{&backend.MaxProtocolVersion, "PGMAXPROTOCOLVERSION"},
+	}
+	for _, d := range defaults {
+		if *d.option == "" {
+			*d.option = os.Getenv(d.variable)
+		}
+	}
+	if backend.SSLMode == "" {
+		backend.SSLMode = SSLModePrefer
+	}
+	if backend.SSLNegotiation == "" {
+		backend.SSLNegotiation = SSLNegotiationPostgres
+	}
+	if backend.MaxProtocolVersion == "" {
+		backend.MaxProtocolVersion = "3.0"
+	}
+}
+
+// FrontendTLSConfig is the TLS policy for clients, the certificate is cert_file and key_file.
+type FrontendTLSConfig struct {
+	// "disable", "allow" (default) or "require": whether clients may, or must, use SSL
+	Mode string `json:"mode"`
+	// "1.2" (default) or "1.3"
+	MinVersion string `json:"min_version"`
+	// TLS 1.2 cipher suites by IANA name, the Go defaults when empty. TLS 1.3 suites are not configurable.
+	CipherSuites []string `json:"cipher_suites"`
+	// "none" (default), "optional" or "required", verified against client_ca
+	ClientCertificates string `json:"client_certificates"`
+	ClientCA           string `json:"client_ca"`
+	// Certificates served instead of cert_file to clients sending a matching SNI server name, first match wins
+	Certificates []*SNICertificateConfig `json:"certificates"`
+	// How often certificate files are checked for changes, 0 disables reloading
+	ReloadInterval Duration `json:"reload_interval"`
+	// Certificates expiring within this window are logged
+	ExpiryWarning Duration `json:"expiry_warning"`
+}
+
+// SNICertificateConfig is a certificate for the server names it matches, "*." wildcards allowed.
+type SNICertificateConfig struct {
+	ServerName string `json:"server_name"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+}
+
+// CertAuthConfig maps client certificates to database users, see CertAuthenticator.
+type CertAuthConfig struct {
+	// Certificate field the identity is read from: "cn" (default) or "san" (DNS names, email addresses and URIs)
+	Identity string                   `json:"identity"`
+	Map      []*IdentityMappingConfig `json:"map"`
+	// Every client must present a certificate mapped to its user, no client falls back to the password
+	Require bool `json:"require"`
+}
+
+// IdentityMappingConfig is a pg_ident.conf style rule.
+type IdentityMappingConfig struct {
+	// Regular expression matched against the certificate identity
+	Certificate string `json:"certificate"`
+	// Database user the identity may log in as, \1 refers to the first group of the expression
+	User string `json:"user"`
+	// Replace the backend credentials of the route when set, otherwise the backend login is the route's
+	BackendUser     string `json:"backend_user"`
+	BackendPassword string `json:"backend_password"`
+	// The user, which must not refer to groups, logs in only with a certificate mapped to it
+	Require bool `json:"require"`
+}
+
+// ClusterConfig groups a primary and its standbys, routes to a cluster follow the current primary.
+type ClusterConfig struct {
+	Backends []string `json:"backends"`
+	// How read/write splitting picks a standby: "round_robin" (default), "least_connections" or "weighted"
+	ReplicaSelection string `json:"replica_selection"`
+	// Standby weights for "weighted" selection, 1 when not given
+	Weights map[string]int `json:"weights"`
+	// Reads stay on the primary for this long after a write, so clients read their own writes
+	StickyAfterWrite Duration `json:"sticky_after_write"`
+	// Functions that read-only statements may call besides the known built-ins, e.g. "stats.report"
+	ReadOnlyFunctions []string `json:"read_only_functions"`
+}
+
+// TracingConfig selects where the spans of sessions and queries are exported to.
+type TracingConfig struct {
+	// "none" (default), "stdout", "file" or "otlp"
+	Exporter string `json:"exporter"`
+	// File the file exporter appends OTLP/JSON lines to
+	File string `json:"file"`
+	// OTLP/HTTP traces endpoint, e.g. http://collector:4318/v1/traces
+	Endpoint string            `json:"endpoint"`
+	Headers  map[string]string `json:"headers"`
+	// Service name of the spans (default pgproxy)
+	ServiceName string `json:"service_name"`
+	// Replace the literals of db.statement with placeholders
+	NormalizeStatements bool `json:"normalize_statements"`
+}
+
+// setOTelDefaults fills in the OpenTelemetry SDK environment variables for settings left out of the configuration.
+func (tracing *TracingConfig) setOTelDefaults() {
+	if tracing.ServiceName == "" {
+		tracing.ServiceName = os.Getenv("OTEL_SERVICE_NAME")
+	}
+	if tracing.ServiceName == "" {
+		tracing.ServiceName = DefaultTracingServiceName
+	}
+	if tracing.Endpoint == "" {
+		tracing.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); tracing.Endpoint == "" && endpoint != "" {
+		tracing.Endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+}
+
+// AdminConfig opens the admin console, see postgres-admin.go, to the users listed.
+type AdminConfig struct {
+	// Database name that reaches the console instead of a backend
+	Database string `json:"database"`
+	// Passwords of the console users by user name. Users with an empty password log in by certificate only.
+	Users map[string]string `json:"users"`
+}
+
+// Enabled reports whether anybody may use the admin console.
+func (admin *AdminConfig) Enabled() bool {
+	return admin.Database != "" && len(admin.Users) > 0
+}
+
+// HealthCheckConfig schedules the probes of every backend, an interval of 0 disables them.
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	// Database the probes log in to
+	Database string `json:"database"`
+}
+
+// PoolConfig sizes and maintains the pools of authenticated backend connections.
+type PoolConfig struct {
+	// "session" (default) or "transaction"
+	Mode            string   `json:"mode"`
+	MinSize         int      `json:"min_size"`
+	MaxSize         int      `json:"max_size"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	MaxLifetime     Duration `json:"max_lifetime"`
+	ResetQuery      string   `json:"reset_query"`
+	ValidationQuery string   `json:"validation_query"`
+	// How long a client waits for a connection of a full pool, 0 fails immediately
+	WaitTimeout Duration `json:"wait_timeout"`
+	// Maximum number of waiting clients, 0 for no limit
+	MaxWaiting int `json:"max_waiting"`
+	// Waiting clients are served in turn per "user" (default) or "application_name"
+	FairnessKey string          `json:"fairness_key"`
+	Priorities  []*PriorityRule `json:"priorities"`
+}
+
+// PriorityRule puts matching clients in a priority class of the wait queue, higher classes are served first.
+type PriorityRule struct {
+	User            string `json:"user"`
+	ApplicationName string `json:"application_name"`
+	Priority        int    `json:"priority"`
+}
+
+// Duration is a time.Duration read from a JSON string such as "5m" or "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) (err error) {
+	var value string
+	if err = json.Unmarshal(data, &value); err != nil {
+		return
+	}
+	d.Duration, err = time.ParseDuration(value)
+	return
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// RouteConfig matches client startup attributes against a backend. Empty match fields match anything.
+type RouteConfig struct {
+	Database        string `json:"database"`
+	User            string `json:"user"`
+	ApplicationName string `json:"application_name"`
+	ServerName      string `json:"server_name"`
+	Backend         string `json:"backend"`
+	// Sends the client to the primary of a cluster instead of a fixed backend
+	Cluster string `json:"cluster"`
+	// Sends read-only statements outside of transactions to the cluster's standbys
+	ReadWriteSplit bool `json:"read_write_split"`
+	// Standbys lagging further behind the primary don't serve reads, 0 for no limit
+	MaxReplicaLag Duration `json:"max_replica_lag"`
+	// Rewrites the client database name to the real backend database name
+	BackendDatabase string `json:"backend_database"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:     DefaultListenAddress,
+		HTTPListen: DefaultHTTPListenAddress,
+		CertFile:   "/opt/bin/proxy-crt.pem",
+		KeyFile:    "/opt/bin/proxy-key.pem",
+		Backends: map[string]*BackendConfig{
+			"postgres": {
+				Address:  "postgres:5432",
+				Username: "postgres",
+				Password: "postgres",
+			},
+		},
+		DefaultRoute: &RouteConfig{Backend: "postgres"},
+		MaxPools:     DefaultMaxPools,
+		Users:        map[string]string{"postgres": "postgres"},
+		Pool: PoolConfig{
+			Mode:        PoolModeSession,
+			MaxSize:     20,
+			IdleTimeout: Duration{10 * time.Minute},
+			MaxLifetime: Duration{time.Hour},
+			ResetQuery:  "DISCARD ALL",
+			WaitTimeout: Duration{30 * time.Second},
+			FairnessKey: FairnessKeyUser,
+		},
+		TLS: FrontendTLSConfig{
+			Mode:               FrontendSSLAllow,
+			MinVersion:         "1.2",
+			ClientCertificates: ClientCertificatesNone,
+			ReloadInterval:     Duration{DefaultCertificateReloadInterval},
+			ExpiryWarning:      Duration{DefaultCertificateExpiryWarning},
+		},
+		HealthCheck: HealthCheckConfig{
+			Interval: Duration{2 * time.Second},
+			Timeout:  Duration{3 * time.Second},
+			Database: "postgres",
+		},
+		Admin:           AdminConfig{Database: DefaultAdminDatabase},
+		ShutdownTimeout: Duration{30 * time.Second},
+		TrackParameters: DefaultTrackedParameters,
+	}
+}
+
+// PoolConfig returns the pool settings for a backend.
+func (config *Config) PoolConfig(backend *BackendConfig) PoolConfig {
+	if backend.pool != nil {
+		return *backend.pool
+	}
+	return config.Pool
+}
+
+// setPoolConfig merges the backend's pool settings over the global ones.
+func (backend *BackendConfig) setPoolConfig(global PoolConfig) error {
+	if len(backend.Pool) == 0 {
+		return nil
+	}
+	pool := global
+	// Unmarshalling decodes into the rules already there, which must not be the global ones
+	pool.Priorities = nil
+	for _, rule := range global.Priorities {
+		copied := *rule
+		pool.Priorities = append(pool.Priorities, &copied)
+	}
+	if err := json.Unmarshal(backend.Pool, &pool); err != nil {
+		return fmt.Errorf("pool: %w", err)
+	}
+	backend.pool = &pool
+	return nil
+}
+
+// AllRoutes returns the routes followed by the default route, if any.
+func (config *Config) AllRoutes() []*RouteConfig {
+	routes := append([]*RouteConfig{}, config.Routes...)
+	if config.DefaultRoute != nil {
+		routes = append(routes, config.DefaultRoute)
+	}
+	return routes
+}
+
+func LoadConfig(path string) (_ *Config, err error) {
+	data, err := os.ReadFile(path)
+	config := DefaultConfig()
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	} else if err != nil {
+		return
+	} else {
+		config.Backends = nil
+		config.DefaultRoute = nil
+		config.Users = nil
+		if err = json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("config %v: %w", path, err)
+		}
+	}
+	for name, backend := range config.Backends {
+		if backend == nil {
+			continue
+		}
+		backend.setLibpqDefaults()
+		if err = backend.setPoolConfig(config.Pool); err != nil {
+			return nil, fmt.Errorf("config %v: backend %q: %w", path, name, err)
+		}
+	}
+	config.Tracing.setOTelDefaults()
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("config %v: %w", path, err)
+	}
+	return config, nil
+}
+
+func (config *Config) Validate() error {
+	if len(config.Backends) == 0 {
+		return errors.New("no backends configured")
+	}
+	if config.MaxPools < 1 {
+		return errors.New("max_pools must be at least 1")
+	}
+	for name, backend := range config.Backends {
+		if backend.Address == "" {
+			return fmt.Errorf("backend %q: address is required", name)
+		}
+		switch backend.SSLMode {
+		case SSLModeDisable, SSLModeAllow, SSLModePrefer, SSLModeRequire:
+		case SSLModeVerifyCA, SSLModeVerifyFull:
+			if backend.SSLRootCert == "" {
+				return fmt.Errorf("backend %q: sslmode %v needs sslrootcert", name, backend.SSLMode)
+			}
+		default:
+			return fmt.Errorf("backend %q: unknown sslmode %q", name, backend.SSLMode)
+		}
+		switch backend.SSLNegotiation {
+		case SSLNegotiationPostgres:
+		case SSLNegotiationDirect:
+			// As in libpq, direct negotiation can't fall back to plaintext
+			switch backend.SSLMode {
+			case SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+			default:
+				return fmt.Errorf("backend %q: sslnegotiation direct needs sslmode require or stronger", name)
+			}
+		default:
+			return fmt.Errorf("backend %q: unknown sslnegotiation %q", name, backend.SSLNegotiation)
+		}
+		if _, ok := protocolVersions[backend.MaxProtocolVersion]; !ok {
+			return fmt.Errorf("backend %q: unsupported max_protocol_version %q", name, backend.MaxProtocolVersion)
+		}
+		if (backend.SSLCert == "") != (backend.SSLKey == "") {
+			return fmt.Errorf("backend %q: sslcert and sslkey go together", name)
+		}
+		pool := config.PoolConfig(backend)
+		if pool.MaxSize < 1 || pool.MinSize < 0 || pool.MinSize > pool.MaxSize {
+			return fmt.Errorf("backend %q: pool sizes must satisfy 0 <= min_size <= max_size, max_size >= 1", name)
+		}
+		switch pool.Mode {
+		case "", PoolModeSession, PoolModeTransaction:
+		default:
+			return fmt.Errorf("backend %q: unknown pool mode %q", name, pool.Mode)
+		}
+		switch pool.FairnessKey {
+		case "", FairnessKeyUser, FairnessKeyApplicationName:
+		default:
+			return fmt.Errorf("backend %q: unknown fairness_key %q", name, pool.FairnessKey)
+		}
+		if pool.WaitTimeout.Duration < 0 || pool.MaxWaiting < 0 {
+			return fmt.Errorf("backend %q: wait_timeout and max_waiting must not be negative", name)
+		}
+	}
+	for _, route := range config.AllRoutes() {
+		if route.Cluster != "" {
+			if route.Backend != "" {
+				return fmt.Errorf("route to cluster %q must not name a backend", route.Cluster)
+			}
+			if _, ok := config.Clusters[route.Cluster]; !ok {
+				return fmt.Errorf("route references unknown cluster %q", route.Cluster)
+			}
+			continue
+		}
+		if route.ReadWriteSplit {
+			return fmt.Errorf("route to backend %q: read_write_split needs a cluster", route.Backend)
+		}
+		if _, ok := config.Backends[route.Backend]; !ok {
+			return fmt.Errorf("route references unknown backend %q", route.Backend)
+		}
+	}
+	for name, cluster := range config.Clusters {
+		if len(cluster.Backends) == 0 {
+			return fmt.Errorf("cluster %q: no backends configured", name)
+		}
+		for _, backend := range cluster.Backends {
+			if _, ok := config.Backends[backend]; !ok {
+				return fmt.Errorf("cluster %q references unknown backend %q", name, backend)
+			}
+		}
+		switch cluster.ReplicaSelection {
+		case "", ReplicaSelectionRoundRobin, ReplicaSelectionLeastConnections, ReplicaSelectionWeighted:
+		default:
+			return fmt.Errorf("cluster %q: unknown replica_selection %q", name, cluster.ReplicaSelection)
+		}
+		for backend, weight := range cluster.Weights {
+			if weight < 0 {
+				return fmt.Errorf("cluster %q: weight of backend %q must not be negative", name, backend)
+			}
+		}
+	}
+	switch config.TLS.Mode {
+	case FrontendSSLDisable, FrontendSSLAllow, FrontendSSLRequire:
+	default:
+		return fmt.Errorf("tls: unknown mode %q", config.TLS.Mode)
+	}
+	switch config.Tracing.Exporter {
+	case "", TracingExporterNone, TracingExporterStdout:
+	case TracingExporterFile:
+		if config.Tracing.File == "" {
+			return errors.New("tracing: the file exporter needs a file")
+		}
+	case TracingExporterOTLP:
+		if config.Tracing.Endpoint == "" {
+			return errors.New("tracing: the otlp exporter needs an endpoint")
+		}
+	default:
+		return fmt.Errorf("tracing: unknown exporter %q", config.Tracing.Exporter)
+	}
+	if config.ShutdownTimeout.Duration < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return errors.New("cert_file and key_file go together")
+	}
+	for i, certificate := range config.TLS.Certificates {
+		if certificate.ServerName == "" || certificate.CertFile == "" || certificate.KeyFile == "" {
+			return fmt.Errorf("tls: certificate %d needs server_name, cert_file and key_file", i)
+		}
+	}
+	if _, ok := tlsVersions[config.TLS.MinVersion]; !ok {
+		return fmt.Errorf("tls: unsupported min_version %q", config.TLS.MinVersion)
+	}
+	switch config.TLS.ClientCertificates {
+	case ClientCertificatesNone:
+	case ClientCertificatesOptional, ClientCertificatesRequired:
+		if config.TLS.ClientCA == "" {
+			return fmt.Errorf("tls: client_certificates %v needs client_ca", config.TLS.ClientCertificates)
+		}
+	default:
+		return fmt.Errorf("tls: unknown client_certificates %q", config.TLS.ClientCertificates)
+	}
+	switch config.CertAuth.Identity {
+	case "", CertIdentityCommonName, CertIdentitySAN:
+	default:
+		return fmt.Errorf("cert_auth: unknown identity %q", config.CertAuth.Identity)
+	}
+	if len(config.CertAuth.Map) > 0 && config.TLS.ClientCertificates == ClientCertificatesNone {
+		return errors.New("cert_auth needs tls client_certificates optional or required")
+	}
+	if config.CertAuth.Require && len(config.CertAuth.Map) == 0 {
+		return errors.New("cert_auth: require needs map rules")
+	}
+	for i, mapping := range config.CertAuth.Map {
+		if mapping.Require && identityGroupPattern.MatchString(mapping.User) {
+			return fmt.Errorf("cert_auth: map rule %d requires a certificate for a user that refers to groups", i)
+		}
+	}
+	if config.HealthCheck.Interval.Duration < 0 || config.HealthCheck.Timeout.Duration < 0 {
+		return errors.New("health_check interval and timeout must not be negative")
+	}
+	return nil
+}
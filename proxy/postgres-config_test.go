@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testPoolConfig returns the default pool settings changed by change.
+func testPoolConfig(change func(pool *PoolConfig)) PoolConfig {
+	pool := DefaultConfig().Pool
+	change(&pool)
+	return pool
+}
+
+func TestBackendPoolConfig(t *testing.T) {
+	global := `"pool": {"mode": "transaction", "max_size": 20, "wait_timeout": "5s",
+		"priorities": [{"user": "admin", "priority": 1}]}`
+	tests := []struct {
+		name   string
+		config string
+		pool   PoolConfig
+	}{
+		{
+			name:   "global settings",
+			config: `{` + global + `, "backends": {"pg": {"address": "pg:5432"}}}`,
+			pool: testPoolConfig(func(pool *PoolConfig) {
+				pool.Mode, pool.MaxSize, pool.WaitTimeout = PoolModeTransaction, 20, Duration{5 * time.Second}
+				pool.Priorities = []*PriorityRule{{User: "admin", Priority: 1}}
+			}),
+		},
+		{
+			name:   "backend setting over the global ones",
+			config: `{` + global + `, "backends": {"pg": {"address": "pg:5432", "pool": {"max_size": 50}}}}`,
+			pool: testPoolConfig(func(pool *PoolConfig) {
+				pool.Mode, pool.MaxSize, pool.WaitTimeout = PoolModeTransaction, 50, Duration{5 * time.Second}
+				pool.Priorities = []*PriorityRule{{User: "admin", Priority: 1}}
+			}),
+		},
+		{
+			name: "backend settings set to zero",
+			config: `{` + global + `, "backends": {"pg": {"address": "pg:5432",
+				"pool": {"mode": "", "wait_timeout": "0s", "priorities": []}}}}`,
+			pool: testPoolConfig(func(pool *PoolConfig) {
+				pool.Mode, pool.MaxSize, pool.WaitTimeout = "", 20, Duration{}
+				pool.Priorities = []*PriorityRule{}
+			}),
+		},
+		{
+			name:   "backend settings over the defaults",
+			config: `{"backends": {"pg": {"address": "pg:5432", "pool": {"max_size": 50}}}}`,
+			pool: testPoolConfig(func(pool *PoolConfig) {
+				pool.MaxSize = 50
+			}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.json")
+			if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pool := config.PoolConfig(config.Backends["pg"]); !reflect.DeepEqual(pool, test.pool) {
+				t.Errorf("PoolConfig() = %+v, want %+v", pool, test.pool)
+			}
+		})
+	}
+}
+
+func TestBackendPoolConfigKeepsGlobalPriorities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	config := `{"pool": {"priorities": [{"user": "admin", "priority": 1}]},
+		"backends": {"pg": {"address": "pg:5432", "pool": {"priorities": [{"user": "batch", "priority": -1}]}}}}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priorities := loaded.Pool.Priorities
+	if len(priorities) != 1 {
+		t.Fatalf("%d global priorities, want 1", len(priorities))
+	}
+	if priorities[0].User != "admin" {
+		t.Errorf("global priority changed to %+v", *priorities[0])
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -12,14 +19,30 @@ const (
 
 type PGConnection struct {
 	Conn        net.Conn
-	C           chan Packet
 	username    string
 	password    string
 	database    string
 	application string
+	attributes  map[string]string
 	cmutex      sync.Mutex
-	certFile    string
-	keyFile     string
+
+	// Backend session state, recorded while the connection is established
+	parameters map[string]string
+	// Negotiated protocol version
+	protocolVersion int32
+	processID       int32
+	secretKey       []byte
+	createdAt       time.Time
+	lastUsed        time.Time
+	// Prepared statements on the backend, by statement key (see StatementTracker)
+	prepared map[string]string
+	// Pool the backend connection belongs to
+	pool *Pool
+	// Settings of the backend, for backend connections
+	backend *BackendConfig
+	// Counters of the message bytes read and written, if set
+	received *atomic.Uint64
+	sent     *atomic.Uint64
 }
 
 type Packet struct {
@@ -34,73 +57,285 @@ func (pg *PGConnection) Close() error {
 
 func (pg *PGConnection) SendMessage(msg []byte) Packet {
 	length, err := pg.Conn.Write(msg)
+	if pg.sent != nil {
+		pg.sent.Add(uint64(length))
+	}
 	return Packet{Body: nil, Length: length, Error: err}
 }
 
-func (pg *PGConnection) ReceiveMessage() Packet {
-	buffer := make([]byte, 4096)
-	length, err := pg.Conn.Read(buffer)
-	return Packet{Body: buffer, Length: length, Error: err}
+/**
+ * ReadStartupMessage reads exactly one untyped message of the startup phase (length and body):
+ * a StartupMessage, SSLRequest, GSSENCRequest or CancelRequest.
+ */
+func (pg *PGConnection) ReadStartupMessage() Packet {
+	header := make([]byte, 4)
+	if n, err := io.ReadFull(pg.Conn, header); err != nil {
+		return Packet{Length: n, Error: err}
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	if length < 8 || length > MaxStartupMessageLength {
+		return Packet{Length: len(header), Error: fmt.Errorf("invalid startup packet length %d", length)}
+	}
+	msg := make([]byte, length)
+	copy(msg, header)
+	n, err := io.ReadFull(pg.Conn, msg[len(header):])
+	if pg.received != nil {
+		pg.received.Add(uint64(len(header) + n))
+	}
+	return Packet{Body: msg, Length: len(header) + n, Error: err}
+}
+
+/**
+ * ReadMessage reads exactly one typed message (type byte, length and body).
+ *
+ * On error, Length reports how many bytes of the message were consumed, so the caller
+ * can tell whether the connection stopped on a message boundary.
+ */
+func (pg *PGConnection) ReadMessage() Packet {
+	return pg.ReadMessageLimit(MaxMessageLength)
+}
+
+/**
+ * ReadMessageLimit reads one typed message of at most limit bytes after the type byte.
+ *
+ * Messages longer than MessageBufferSize are read into a buffer that grows with the bytes received,
+ * so a peer announcing a long message doesn't get the memory before it sends the message.
+ */
+func (pg *PGConnection) ReadMessageLimit(limit int) Packet {
+	header := make([]byte, 5)
+	if n, err := io.ReadFull(pg.Conn, header); err != nil {
+		return Packet{Length: n, Error: err}
+	}
+	length := int(binary.BigEndian.Uint32(header[1:5]))
+	if length < 4 || length > limit {
+		return Packet{Length: len(header), Error: fmt.Errorf("invalid message length %d for message type %q", length, header[0])}
+	}
+	var msg []byte
+	var n int
+	var err error
+	if length <= MessageBufferSize {
+		msg = make([]byte, 1+length)
+		copy(msg, header)
+		n, err = io.ReadFull(pg.Conn, msg[len(header):])
+	} else {
+		buffer := bytes.NewBuffer(make([]byte, 0, MessageBufferSize))
+		buffer.Write(header)
+		var copied int64
+		copied, err = io.CopyN(buffer, pg.Conn, int64(length-4))
+		msg, n = buffer.Bytes(), int(copied)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if pg.received != nil {
+		pg.received.Add(uint64(len(header) + n))
+	}
+	return Packet{Body: msg, Length: len(header) + n, Error: err}
+}
+
+/**
+ * SimpleQuery runs a query with the simple query protocol and returns the text values of all data rows.
+ *
+ * The connection is always read up to ReadyForQuery, so it stays usable after an ErrorResponse.
+ */
+func (pg *PGConnection) SimpleQuery(query string) (rows [][][]byte, err error) {
+	message, err := CreateQueryMessage(query)
+	if err != nil {
+		return
+	}
+	if packet := pg.SendMessage(message); packet.Error != nil {
+		return nil, packet.Error
+	}
+	for {
+		packet := pg.ReadMessage()
+		if packet.Error != nil {
+			return nil, packet.Error
+		}
+		switch GetMessageType(packet.Body) {
+		case MessageTypeDataRow:
+			values, perr := GetDataRowValues(packet.Body)
+			if perr != nil {
+				return nil, perr
+			}
+			rows = append(rows, values)
+		case MessageTypeErrorResponse:
+			err = GetErrorResponse(packet.Body)
+		case MessageTypeParameterStatus:
+			pg.recordParameterStatus(packet.Body)
+		case MessageTypeReadyForQuery:
+			return rows, err
+		}
+	}
 }
 
-func (pg *PGConnection) sendStartupMessage() {
+func (pg *PGConnection) Exec(query string) error {
+	_, err := pg.SimpleQuery(query)
+	return err
+}
+
+func (pg *PGConnection) recordParameterStatus(msg []byte) {
+	name, value, err := GetParameterStatus(msg)
+	if err != nil {
+		return
+	}
+	if pg.parameters == nil {
+		pg.parameters = make(map[string]string)
+	}
+	pg.parameters[name] = value
+}
+
+func (pg *PGConnection) sendStartupMessage() error {
 	params := make(map[string]string)
-	params[ConnectionAttributeApplicationName] = pg.application
-	msg, err := CreateStartupMessage(pg.username, pg.password, params)
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(msg)
+	if pg.application != "" {
+		params[ConnectionAttributeApplicationName] = pg.application
+	}
+	msg, err := CreateStartupMessage(pg.protocolVersion, pg.username, pg.database, params)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(msg).Error
 }
 
-func (pg *PGConnection) sendPasswordResponse() {
+func (pg *PGConnection) sendPasswordResponse() error {
 	msg, err := CreatePasswordResponseMessage(pg.password)
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(msg)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(msg).Error
+}
+
+func (pg *PGConnection) sendTerminate() error {
+	msg, err := CreateTerminateMessage()
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(msg).Error
 }
 
 func (pg *PGConnection) isAuthenticationOK(msg []byte) bool {
 	authType, err := GetAuthenticationType(msg)
-	pg.C <- Packet{Error: err}
-	return AuthenticationOK == authType
+	return err == nil && AuthenticationOK == authType
 }
 
-func (pg *PGConnection) sendAuthenticationClearTextPasswordRequest() {
+func (pg *PGConnection) sendAuthenticationClearTextPasswordRequest() error {
 	msg, err := AuthenticationClearTextPasswordRequestMessage()
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(msg)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(msg).Error
 }
 
-func (pg *PGConnection) sendAuthenticationOKResponse() {
+func (pg *PGConnection) sendAuthenticationOKResponse() error {
 	message, err := AuthenticationOkResponseMessage()
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(message)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
 }
 
-func (pg *PGConnection) sendParameterStatus(key, value string) {
+func (pg *PGConnection) sendParameterStatus(key, value string) error {
 	message, err := ParameterStatusMessage(key, value)
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(message)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
 }
 
-func (pg *PGConnection) sendBackendKeyData(pid, key int32) {
+func (pg *PGConnection) sendBackendKeyData(pid int32, key []byte) error {
 	message, err := BackendKeyDataMessage(pid, key)
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(message)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
 }
 
-func (pg *PGConnection) sendReadyForQuery() {
+func (pg *PGConnection) sendReadyForQuery() error {
 	message, err := ReadyForQueryMessage()
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(message)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
 }
 
-func (pg *PGConnection) sendSSLRequest() {
+func (pg *PGConnection) sendSSLRequest() error {
 	message, err := SSLRequestMessage()
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(message)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
 }
 
-func (pg *PGConnection) sendSSLResponse(sslCode byte) {
+func (pg *PGConnection) sendSSLResponse(sslCode byte) error {
 	message, err := SSLResponseMessage(sslCode)
-	pg.C <- Packet{Error: err}
-	pg.C <- pg.SendMessage(message)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
 }
+
+func (pg *PGConnection) sendNegotiateProtocolVersion(minorVersion int32, options []string) error {
+	message, err := NegotiateProtocolVersionMessage(minorVersion, options)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
+}
+
+func (pg *PGConnection) sendCancelRequest(processID int32, secretKey []byte) error {
+	message, err := CancelRequestMessage(processID, secretKey)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
+}
+
+func (pg *PGConnection) sendErrorResponse(severity, code, text string) error {
+	message, err := ErrorResponseMessage(severity, code, text)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
+}
+
+func (pg *PGConnection) sendNoticeResponse(severity, code, text string) error {
+	message, err := NoticeResponseMessage(severity, code, text)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
+}
+
+// sendRows sends a result set of text values and the CommandComplete that ends it.
+func (pg *PGConnection) sendRows(columns []string, rows [][]string, tag string) error {
+	message, err := RowDescriptionMessage(columns)
+	if err != nil {
+		return err
+	}
+	if err := pg.SendMessage(message).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		values := make([][]byte, len(row))
+		for i, value := range row {
+			values[i] = []byte(value)
+		}
+		if message, err = DataRowMessage(values); err != nil {
+			return err
+		}
+		if err := pg.SendMessage(message).Error; err != nil {
+			return err
+		}
+	}
+	return pg.sendCommandComplete(tag)
+}
+
+func (pg *PGConnection) sendCommandComplete(tag string) error {
+	message, err := CommandCompleteMessage(tag)
+	if err != nil {
+		return err
+	}
+	return pg.SendMessage(message).Error
+}
+
+// ErrAuthenticationNotSupported is returned when a backend asks for an authentication method the proxy can't answer.
+var ErrAuthenticationNotSupported = errors.New("auth type not supported")
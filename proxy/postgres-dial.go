@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+/**
+
+Proxy(F)                                       Backend(B)
+|             SSL Request                        |
+|----------------------------------------------->|
+|             SSL Response ('S' or 'N')          |
+|<-----------------------------------------------|
+|             Startup Message                    |
+|----------------------------------------------->|
+|             Password Request                   |
+|<-----------------------------------------------|
+|             Password Response                  |
+|----------------------------------------------->|
+|             AuthenticationOK                   |
+|<-----------------------------------------------|
+|             Parameter Status (*)               |
+|<-----------------------------------------------|
+|             BackendKeyData                     |
+|<-----------------------------------------------|
+|             ReadyForQuery                      |
+|<-----------------------------------------------|
+
+*/
+
+const BackendDialTimeout = 10 * time.Second
+
+// NewBackendConnection prepares (but does not dial) a backend connection for a route.
+func NewBackendConnection(route *Route, application string) *PGConnection {
+	return &PGConnection{
+		username:    route.Username,
+		password:    route.Password,
+		database:    route.Database,
+		application: application,
+		backend:     route.Backend,
+	}
+}
+
+/**
+ * Dial connects to the backend and completes the startup handshake.
+ *
+ * On success the connection is idle (ReadyForQuery has been consumed) and the backend's
+ * ParameterStatus values and cancellation key have been recorded.
+ */
+func (pg *PGConnection) Dial(address string) error {
+	return pg.DialTimeout(address, BackendDialTimeout)
+}
+
+/**
+ * DialTimeout is Dial with a time limit for connecting and completing the handshake.
+ *
+ * As in libpq, sslmode "allow" first tries without SSL and only retries with SSL when that fails.
+ */
+func (pg *PGConnection) DialTimeout(address string, timeout time.Duration) error {
+	mode := pg.backend.SSLMode
+	if mode == SSLModeAllow {
+		err := pg.dial(address, timeout, false)
+		if err == nil {
+			return nil
+		}
+		log.Printf("backend %v: plaintext connection failed, retrying with SSL: %v", address, err)
+	}
+	return pg.dial(address, timeout, mode != SSLModeDisable)
+}
+
+func (pg *PGConnection) dial(address string, timeout time.Duration, ssl bool) (err error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return
+	}
+	pg.Conn = conn
+	pg.parameters = make(map[string]string)
+	pg.protocolVersion = protocolVersions[pg.backend.MaxProtocolVersion]
+	defer func() {
+		if err != nil {
+			_ = pg.Conn.Close()
+		}
+	}()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	switch {
+	case ssl && pg.backend.SSLNegotiation == SSLNegotiationDirect:
+		if err = pg.upgradeClient(address); err != nil {
+			return
+		}
+	case ssl:
+		if err = pg.negotiateSSL(address); err != nil {
+			return
+		}
+	}
+	if err = pg.startup(); err != nil {
+		return
+	}
+	if err = pg.Conn.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+	pg.createdAt = time.Now()
+	pg.lastUsed = pg.createdAt
+	return nil
+}
+
+// negotiateSSL sends an SSLRequest and upgrades the connection, or carries on in plaintext when sslmode permits it.
+func (pg *PGConnection) negotiateSSL(address string) error {
+	if err := pg.sendSSLRequest(); err != nil {
+		return err
+	}
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(pg.Conn, response); err != nil {
+		return err
+	}
+	switch response[0] {
+	case SSLAllowed:
+		return pg.upgradeClient(address)
+	case SSLNotAllowed:
+		if mode := pg.backend.SSLMode; mode == SSLModePrefer || mode == SSLModeAllow {
+			return nil
+		}
+		return fmt.Errorf("backend %v does not support SSL, but sslmode %v requires it", address, pg.backend.SSLMode)
+	default:
+		return fmt.Errorf("backend %v sent an invalid response to SSL negotiation: %q", address, response[0])
+	}
+}
+
+/**
+ * upgradeClient runs the TLS handshake with the backend.
+ *
+ * Certificates are verified as libpq does: verify-full checks the chain and the backend's host name,
+ * verify-ca only the chain, and require only when a root certificate is configured.
+ * allow and prefer accept any certificate.
+ *
+ * With direct negotiation the backend must select the postgresql ALPN protocol.
+ */
+func (pg *PGConnection) upgradeClient(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{ALPNProtocolPostgreSQL},
+	}
+	rootCAs, crt := pg.backend.certificates.Backend(pg.backend)
+	if crt != nil {
+		config.Certificates = []tls.Certificate{*crt}
+	}
+	mode := pg.backend.SSLMode
+	if mode == SSLModeRequire && rootCAs != nil {
+		mode = SSLModeVerifyCA
+	}
+	switch mode {
+	case SSLModeVerifyFull:
+		config.RootCAs = rootCAs
+	case SSLModeVerifyCA:
+		config.RootCAs = rootCAs
+		// The chain is verified below, without the host name
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyChain(state, config.RootCAs)
+		}
+	default:
+		config.InsecureSkipVerify = true
+	}
+	conn := tls.Client(pg.Conn, config)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("backend %v: %w", address, err)
+	}
+	if pg.backend.SSLNegotiation == SSLNegotiationDirect && conn.ConnectionState().NegotiatedProtocol != ALPNProtocolPostgreSQL {
+		_ = conn.Close()
+		return fmt.Errorf("backend %v: direct SSL connection without the %v ALPN protocol", address, ALPNProtocolPostgreSQL)
+	}
+	pg.Conn = conn
+	return nil
+}
+
+func verifyChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("backend sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, crt := range state.PeerCertificates[1:] {
+		intermediates.AddCert(crt)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func (pg *PGConnection) startup() error {
+	// Send startup request to backend
+	if err := pg.sendStartupMessage(); err != nil {
+		return err
+	}
+	for {
+		packet := pg.ReadMessage()
+		if packet.Error != nil {
+			return packet.Error
+		}
+		switch GetMessageType(packet.Body) {
+		case MessageTypeAuthentication:
+			if err := pg.authenticate(packet.Body); err != nil {
+				return err
+			}
+		case MessageTypeNegotiateProtocolVersion:
+			// The backend speaks an older 3.x minor version than requested
+			minor, _, err := GetNegotiateProtocolVersion(packet.Body)
+			if err != nil {
+				return err
+			}
+			if minor < ProtocolMinorVersion(pg.protocolVersion) {
+				pg.protocolVersion = ProtocolVersion&^0xffff | minor
+			}
+		case MessageTypeParameterStatus:
+			pg.recordParameterStatus(packet.Body)
+		case MessageTypeBackendKeyData:
+			processID, secretKey, err := GetBackendKeyData(packet.Body)
+			if err != nil {
+				return err
+			}
+			pg.processID, pg.secretKey = processID, secretKey
+		case MessageTypeErrorResponse:
+			return GetErrorResponse(packet.Body)
+		case MessageTypeReadyForQuery:
+			return nil
+		}
+	}
+}
+
+func (pg *PGConnection) authenticate(msg []byte) error {
+	authType, err := GetAuthenticationType(msg)
+	if err != nil {
+		return err
+	}
+	switch authType {
+	case AuthenticationOK:
+		return nil
+	case AuthenticationClearTextPassword:
+		// Send the clearText password response
+		return pg.sendPasswordResponse()
+	default:
+		return fmt.Errorf("%w: %d", ErrAuthenticationNotSupported, authType)
+	}
+}
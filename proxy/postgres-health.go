@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Backend health checking
+ *
+ * Every backend is probed on a schedule: the checker connects and logs in like a pooled connection would,
+ * then runs SELECT pg_is_in_recovery(). A node answering false is a primary ("up"), one answering true is
+ * a standby, and a node that can't be reached or logged in to is down.
+ *
+ * Routes to a cluster resolve to the member that is currently primary, so after a failover new sessions
+ * follow the promoted node on the next probe. While several members claim to be primary, the cluster has no
+ * primary to route to.
+ */
+
+const (
+	NodeStateUnknown = "unknown"
+	NodeStateUp      = "up"
+	NodeStateStandby = "standby"
+	NodeStateDown    = "down"
+)
+
+const HealthCheckQuery = "SELECT pg_is_in_recovery()"
+
+/**
+ * ReplicationLagQuery returns a standby's replay lag in seconds and whether its WAL receiver is streaming.
+ *
+ * The lag is 0 when a streaming standby has replayed everything it received, otherwise the age of the last
+ * replayed transaction, NULL until a transaction has been replayed. A standby that lost its WAL receiver has
+ * replayed all it received too, so it is not taken for caught up. Roles without pg_read_all_stats see no
+ * status in pg_stat_wal_receiver, for them a running receiver counts as streaming.
+ */
+const ReplicationLagQuery = "SELECT CASE WHEN r.streaming AND pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() " +
+	"THEN 0 ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END, r.streaming " +
+	"FROM (SELECT EXISTS (SELECT FROM pg_stat_wal_receiver " +
+	"WHERE pid IS NOT NULL AND coalesce(status, 'streaming') = 'streaming') AS streaming) r"
+
+var ErrNoPrimary = errors.New("no primary available")
+
+var ErrSeveralPrimaries = errors.New("several primaries")
+
+type NodeHealth struct {
+	State     string
+	LastCheck time.Time
+	LastError error
+	// Consecutive failed probes
+	Failures int
+	// Replay lag of a standby, valid when LagKnown
+	Lag      time.Duration
+	LagKnown bool
+	// The standby's WAL receiver is streaming from the primary
+	Streaming bool
+}
+
+type HealthChecker struct {
+	config *Config
+	mutex  sync.Mutex
+	nodes  map[string]*NodeHealth
+	// Called after a backend changed state, outside of the checker's lock
+	OnChange func(backend string, from, to string)
+}
+
+func NewHealthChecker(config *Config) *HealthChecker {
+	checker := &HealthChecker{
+		config: config,
+		nodes:  make(map[string]*NodeHealth),
+	}
+	for name := range config.Backends {
+		checker.nodes[name] = &NodeHealth{State: NodeStateUnknown}
+	}
+	return checker
+}
+
+/**
+ * Start probes every backend once, so routing has a state to work with, then keeps probing in the background.
+ * Nothing is probed when the health check interval is 0.
+ */
+func (checker *HealthChecker) Start() {
+	if checker.config.HealthCheck.Interval.Duration <= 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for name := range checker.config.Backends {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			checker.check(name)
+		}(name)
+	}
+	wg.Wait()
+	for name := range checker.config.Backends {
+		go checker.run(name)
+	}
+}
+
+func (checker *HealthChecker) run(name string) {
+	ticker := time.NewTicker(checker.config.HealthCheck.Interval.Duration)
+	defer ticker.Stop()
+	for range ticker.C {
+		checker.check(name)
+	}
+}
+
+func (checker *HealthChecker) check(name string) {
+	state, replication, err := checker.probe(checker.config.Backends[name])
+
+	checker.mutex.Lock()
+	node := checker.nodes[name]
+	from := node.State
+	node.State, node.LastCheck, node.LastError = state, time.Now(), err
+	node.Lag, node.LagKnown, node.Streaming = 0, false, false
+	if replication != nil {
+		node.Streaming = replication.streaming
+		if replication.lag != nil {
+			node.Lag, node.LagKnown = *replication.lag, true
+		}
+	}
+	if err != nil {
+		node.Failures++
+	} else {
+		node.Failures = 0
+	}
+	onChange := checker.OnChange
+	checker.mutex.Unlock()
+
+	if from == state {
+		return
+	}
+	if err != nil {
+		log.Printf("health: backend %v is %v: %v", name, state, err)
+	} else {
+		log.Printf("health: backend %v is %v", name, state)
+	}
+	if onChange != nil {
+		onChange(name, from, state)
+	}
+}
+
+// replication is what a standby reports of its replication, see ReplicationLagQuery.
+type replication struct {
+	// nil when the standby can't tell yet
+	lag       *time.Duration
+	streaming bool
+}
+
+/**
+ * probe logs in to a backend with the startup and authentication code of pooled connections.
+ *
+ * For a standby it also returns its replication state, nil when the query failed.
+ */
+func (checker *HealthChecker) probe(backend *BackendConfig) (string, *replication, error) {
+	timeout := checker.config.HealthCheck.Timeout.Duration
+	if timeout <= 0 {
+		timeout = BackendDialTimeout
+	}
+	route := &Route{
+		Backend:  backend,
+		Username: backend.Username,
+		Password: backend.Password,
+		Database: checker.config.HealthCheck.Database,
+	}
+	pg := NewBackendConnection(route, "")
+	if err := pg.DialTimeout(backend.Address, timeout); err != nil {
+		return NodeStateDown, nil, err
+	}
+	defer func() {
+		_ = pg.sendTerminate()
+		_ = pg.Close()
+	}()
+	if err := pg.Conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return NodeStateDown, nil, err
+	}
+	rows, err := pg.SimpleQuery(HealthCheckQuery)
+	if err != nil {
+		return NodeStateDown, nil, err
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return NodeStateDown, nil, fmt.Errorf("unexpected result of %q", HealthCheckQuery)
+	}
+	if string(rows[0][0]) != "t" {
+		return NodeStateUp, nil, nil
+	}
+	state, err := replicationState(pg)
+	if err != nil {
+		log.Printf("health: replication lag of %v: %v", backend.Address, err)
+	}
+	return NodeStateStandby, state, nil
+}
+
+func replicationState(pg *PGConnection) (*replication, error) {
+	rows, err := pg.SimpleQuery(ReplicationLagQuery)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 || len(rows[0]) != 2 {
+		return nil, fmt.Errorf("unexpected result of %q", ReplicationLagQuery)
+	}
+	state := &replication{streaming: string(rows[0][1]) == "t"}
+	if rows[0][0] == nil {
+		return state, nil
+	}
+	seconds, err := strconv.ParseFloat(string(rows[0][0]), 64)
+	if err != nil {
+		return nil, err
+	}
+	lag := time.Duration(seconds * float64(time.Second))
+	state.lag = &lag
+	return state, nil
+}
+
+// State returns the health of a backend.
+func (checker *HealthChecker) State(name string) NodeHealth {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if node, ok := checker.nodes[name]; ok {
+		return *node
+	}
+	return NodeHealth{State: NodeStateUnknown}
+}
+
+// States returns the health of all backends, by backend name.
+func (checker *HealthChecker) States() map[string]NodeHealth {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	states := make(map[string]NodeHealth)
+	for name, node := range checker.nodes {
+		states[name] = *node
+	}
+	return states
+}
+
+/**
+ * Primary returns the member of a cluster that is currently primary.
+ *
+ * Without health checks, the first member is the primary. When several members report they are primary,
+ * e.g. after a failover the old primary didn't learn about, it fails with ErrSeveralPrimaries rather than
+ * sending writes to either.
+ */
+func (checker *HealthChecker) Primary(cluster string) (string, error) {
+	config, ok := checker.config.Clusters[cluster]
+	if !ok {
+		return "", fmt.Errorf("unknown cluster %q", cluster)
+	}
+	if checker.config.HealthCheck.Interval.Duration <= 0 {
+		return config.Backends[0], nil
+	}
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	var primaries []string
+	for _, name := range config.Backends {
+		if checker.nodes[name].State == NodeStateUp {
+			primaries = append(primaries, name)
+		}
+	}
+	if len(primaries) == 0 {
+		return "", fmt.Errorf("%w in cluster %q", ErrNoPrimary, cluster)
+	}
+	if len(primaries) > 1 {
+		return "", fmt.Errorf("%w in cluster %q: %v", ErrSeveralPrimaries, cluster, strings.Join(primaries, ", "))
+	}
+	return primaries[0], nil
+}
+
+/**
+ * Ready checks that every route has a backend the proxy can log in to: the route's backend, or the primary of
+ * the route's cluster. Without scheduled health checks the backends are probed now.
+ */
+func (checker *HealthChecker) Ready(routes []*RouteConfig) (problems []error) {
+	checked := make(map[string]bool)
+	for _, route := range routes {
+		target, name := "backend "+route.Backend, route.Backend
+		if route.Cluster != "" {
+			target = "cluster " + route.Cluster
+		}
+		if checked[target] {
+			continue
+		}
+		checked[target] = true
+		if route.Cluster != "" {
+			primary, err := checker.Primary(route.Cluster)
+			if err != nil {
+				problems = append(problems, err)
+				continue
+			}
+			name = primary
+		}
+		node := checker.State(name)
+		if checker.config.HealthCheck.Interval.Duration <= 0 {
+			node.State, _, node.LastError = checker.probe(checker.config.Backends[name])
+		}
+		if node.State == NodeStateUp || node.State == NodeStateStandby {
+			continue
+		}
+		if node.LastError != nil {
+			problems = append(problems, fmt.Errorf("%v: backend %v is %v: %w", target, name, node.State, node.LastError))
+		} else {
+			problems = append(problems, fmt.Errorf("%v: backend %v is %v", target, name, node.State))
+		}
+	}
+	return problems
+}
+
+/**
+ * Standbys returns the members of a cluster that are up as standbys, in configuration order.
+ *
+ * With a maxLag above 0, standbys lagging further behind, whose lag is unknown or whose WAL receiver
+ * isn't streaming are left out.
+ */
+func (checker *HealthChecker) Standbys(cluster string, maxLag time.Duration) (standbys []string) {
+	config, ok := checker.config.Clusters[cluster]
+	if !ok {
+		return nil
+	}
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	for _, name := range config.Backends {
+		node := checker.nodes[name]
+		if node.State != NodeStateStandby {
+			continue
+		}
+		if maxLag > 0 && (!node.LagKnown || !node.Streaming || node.Lag > maxLag) {
+			continue
+		}
+		standbys = append(standbys, name)
+	}
+	return standbys
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/**
+ * HTTP endpoints, served on http_listen
+ *
+ *   /metrics   Prometheus metrics, see postgres-metrics.go
+ *   /healthz   200 as long as the process runs
+ *   /readyz    200 when the proxy accepts clients and every route has a backend that answers and lets the proxy
+ *              log in, 503 otherwise, including while draining on shutdown
+ *
+ * /readyz relies on the health checks; when they are disabled the backends are probed on each request.
+ */
+
+func NewHTTPHandler(server *Server, router *Router, health *HealthChecker, metrics *Metrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var problems []string
+		if server.Draining() {
+			problems = append(problems, "draining for shutdown")
+		} else if !server.Accepting() {
+			problems = append(problems, "not accepting connections")
+		}
+		for _, err := range health.Ready(router.AllRoutes()) {
+			problems = append(problems, err.Error())
+		}
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	return mux
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Metrics
+ *
+ * Counters of the proxy, served in the Prometheus text format on /metrics of http_listen.
+ *
+ * Sessions, bytes, queries and pool waits are labelled with the backend, database and user of the pool
+ * the session uses, i.e. the backend's credentials after routing. Reads sent to a standby count towards
+ * the standby's pool. Pool sizes, backend health and certificate expiry are read when scraped.
+ */
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	metricTypeCounter   = "counter"
+	metricTypeGauge     = "gauge"
+	metricTypeHistogram = "histogram"
+)
+
+// Reasons of failed client handshakes
+const (
+	HandshakeFailureDisconnected   = "client_disconnected"
+	HandshakeFailureProtocol       = "protocol"
+	HandshakeFailureTLS            = "tls"
+	HandshakeFailureSSLRequired    = "ssl_required"
+	HandshakeFailureCertificate    = "certificate"
+	HandshakeFailureNoRoute        = "no_route"
+	HandshakeFailureBackend        = "backend_unavailable"
+	HandshakeFailurePoolExhausted  = "pool_exhausted"
+	HandshakeFailureAuthentication = "authentication"
+)
+
+const (
+	DirectionFrontendToBackend = "frontend_to_backend"
+	DirectionBackendToFrontend = "backend_to_frontend"
+)
+
+var (
+	QueryDurationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	PoolWaitBuckets      = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30}
+)
+
+var poolLabels = []string{"backend", "database", "user"}
+
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (counter *Counter) Add(n uint64) {
+	counter.value.Add(n)
+}
+
+func (counter *Counter) Inc() {
+	counter.value.Add(1)
+}
+
+func (counter *Counter) Value() uint64 {
+	return counter.value.Load()
+}
+
+func (counter *Counter) write(w io.Writer, name string, labels []string) {
+	fmt.Fprintf(w, "%v%v %d\n", name, formatLabels(labels), counter.value.Load())
+}
+
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (gauge *Gauge) Set(value float64) {
+	gauge.bits.Store(math.Float64bits(value))
+}
+
+func (gauge *Gauge) Add(delta float64) {
+	for {
+		old := gauge.bits.Load()
+		if gauge.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.Add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.Add(-1)
+}
+
+func (gauge *Gauge) write(w io.Writer, name string, labels []string) {
+	fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(labels), formatValue(math.Float64frombits(gauge.bits.Load())))
+}
+
+type Histogram struct {
+	// Upper bounds of the buckets, +Inf is implied
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     Gauge
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]atomic.Uint64, len(buckets))}
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	if i := sort.SearchFloat64s(histogram.buckets, value); i < len(histogram.buckets) {
+		histogram.counts[i].Add(1)
+	}
+	histogram.sum.Add(value)
+	histogram.count.Add(1)
+}
+
+func (histogram *Histogram) ObserveDuration(d time.Duration) {
+	histogram.Observe(d.Seconds())
+}
+
+// Count and Sum return the number and the sum of the observations.
+func (histogram *Histogram) Count() uint64 {
+	return histogram.count.Load()
+}
+
+func (histogram *Histogram) Sum() float64 {
+	return math.Float64frombits(histogram.sum.bits.Load())
+}
+
+// write reports cumulative buckets, as the text format wants them.
+func (histogram *Histogram) write(w io.Writer, name string, labels []string) {
+	var cumulative uint64
+	for i, bound := range histogram.buckets {
+		cumulative += histogram.counts[i].Load()
+		fmt.Fprintf(w, "%v_bucket%v %d\n", name, formatLabels(append(labels[:len(labels):len(labels)],
+			formatLabel("le", formatValue(bound)))), cumulative)
+	}
+	count := histogram.count.Load()
+	fmt.Fprintf(w, "%v_bucket%v %d\n", name, formatLabels(append(labels[:len(labels):len(labels)], formatLabel("le", "+Inf"))), count)
+	fmt.Fprintf(w, "%v_sum%v %v\n", name, formatLabels(labels), formatValue(math.Float64frombits(histogram.sum.bits.Load())))
+	fmt.Fprintf(w, "%v_count%v %d\n", name, formatLabels(labels), count)
+}
+
+type metric interface {
+	write(w io.Writer, name string, labels []string)
+}
+
+type series struct {
+	// Formatted name="value" pairs
+	labels []string
+	metric metric
+}
+
+// family is a metric name with one series per combination of label values.
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	newMetric  func() metric
+	mutex      sync.Mutex
+	series     map[string]*series
+}
+
+func (f *family) with(values ...string) metric {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %v takes %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if s, ok := f.series[key]; ok {
+		return s.metric
+	}
+	s := &series{metric: f.newMetric()}
+	for i, label := range f.labels {
+		s.labels = append(s.labels, formatLabel(label, values[i]))
+	}
+	f.series[key] = s
+	return s.metric
+}
+
+// removePrefix drops the series whose first label values are the given ones.
+func (f *family) removePrefix(values []string) {
+	prefix := strings.Join(values, "\xff")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for key := range f.series {
+		if key == prefix || strings.HasPrefix(key, prefix+"\xff") {
+			delete(f.series, key)
+		}
+	}
+}
+
+// reset drops every series, for metrics set from scratch on each scrape.
+func (f *family) reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.series = make(map[string]*series)
+}
+
+func (f *family) write(w io.Writer) {
+	f.mutex.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mutex.Unlock()
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labels, ",") < strings.Join(all[j].labels, ",")
+	})
+	fmt.Fprintf(w, "# HELP %v %v\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", f.name, f.metricType)
+	for _, s := range all {
+		s.metric.write(w, f.name, s.labels)
+	}
+}
+
+type CounterVec struct{ *family }
+
+func (vec CounterVec) With(values ...string) *Counter {
+	return vec.with(values...).(*Counter)
+}
+
+type GaugeVec struct{ *family }
+
+func (vec GaugeVec) With(values ...string) *Gauge {
+	return vec.with(values...).(*Gauge)
+}
+
+type HistogramVec struct{ *family }
+
+func (vec HistogramVec) With(values ...string) *Histogram {
+	return vec.with(values...).(*Histogram)
+}
+
+type Metrics struct {
+	ClientConnectionsAccepted CounterVec
+	ClientConnections         GaugeVec
+	ClientConnectionsTotal    CounterVec
+	HandshakeFailures         CounterVec
+	Bytes                     CounterVec
+	Queries                   CounterVec
+	QueryErrors               CounterVec
+	QueryDuration             HistogramVec
+	PoolWaitDuration          HistogramVec
+	PoolWaitTimeouts          CounterVec
+
+	// Read from the components below on each scrape
+	clientSessions     GaugeVec
+	backendConnections GaugeVec
+	poolWaiting        GaugeVec
+	backendState       GaugeVec
+	replicationLag     GaugeVec
+	certificateExpiry  GaugeVec
+	Sessions           *SessionRegistry
+	Pools              *PoolManager
+	Health             *HealthChecker
+	Certificates       *CertificateManager
+
+	families []*family
+	scrape   sync.Mutex
+	pmutex   sync.Mutex
+	pools    map[PoolKey]*PoolMetrics
+}
+
+func NewMetrics() *Metrics {
+	metrics := &Metrics{pools: make(map[PoolKey]*PoolMetrics)}
+	metrics.ClientConnectionsAccepted = CounterVec{metrics.family("pgproxy_client_connections_accepted_total",
+		"Client connections accepted.", metricTypeCounter, nil)}
+	metrics.ClientConnectionsAccepted.With()
+	metrics.ClientConnections = GaugeVec{metrics.family("pgproxy_client_connections",
+		"Client sessions connected to a backend.", metricTypeGauge, poolLabels)}
+	metrics.ClientConnectionsTotal = CounterVec{metrics.family("pgproxy_client_connections_total",
+		"Client sessions that completed the startup handshake.", metricTypeCounter, poolLabels)}
+	metrics.HandshakeFailures = CounterVec{metrics.family("pgproxy_handshake_failures_total",
+		"Client connections that failed before the startup handshake completed, by reason.", metricTypeCounter,
+		[]string{"reason"})}
+	metrics.Bytes = CounterVec{metrics.family("pgproxy_bytes_total",
+		"Protocol message bytes relayed between clients and backends.", metricTypeCounter,
+		append(poolLabels, "direction"))}
+	metrics.Queries = CounterVec{metrics.family("pgproxy_queries_total",
+		"Completed SQL commands, by command tag.", metricTypeCounter, append(poolLabels, "command"))}
+	metrics.QueryErrors = CounterVec{metrics.family("pgproxy_query_errors_total",
+		"Error responses of backends to queries, by SQLSTATE.", metricTypeCounter, append(poolLabels, "sqlstate"))}
+	metrics.QueryDuration = HistogramVec{metrics.histogramFamily("pgproxy_query_duration_seconds",
+		"Time from a client's Query or Sync to the backend's ReadyForQuery.", QueryDurationBuckets)}
+	metrics.PoolWaitDuration = HistogramVec{metrics.histogramFamily("pgproxy_pool_wait_duration_seconds",
+		"Time clients spent waiting for a connection of a full pool.", PoolWaitBuckets)}
+	metrics.PoolWaitTimeouts = CounterVec{metrics.family("pgproxy_pool_wait_timeouts_total",
+		"Clients that gave up waiting for a connection of a full pool.", metricTypeCounter, poolLabels)}
+	metrics.clientSessions = GaugeVec{metrics.family("pgproxy_client_sessions",
+		"Client sessions in the session registry, by state (login, active, idle, idle in transaction).",
+		metricTypeGauge, []string{"state"})}
+	metrics.backendConnections = GaugeVec{metrics.family("pgproxy_backend_connections",
+		"Open backend connections per pool, by state (idle or active).", metricTypeGauge,
+		append(poolLabels, "state"))}
+	metrics.poolWaiting = GaugeVec{metrics.family("pgproxy_pool_waiting_clients",
+		"Clients waiting for a connection of a full pool.", metricTypeGauge, poolLabels)}
+	metrics.backendState = GaugeVec{metrics.family("pgproxy_backend_state",
+		"Health of each backend, 1 for its current state (up, standby, down or unknown).", metricTypeGauge,
+		[]string{"backend", "state"})}
+	metrics.replicationLag = GaugeVec{metrics.family("pgproxy_backend_replication_lag_seconds",
+		"Replay lag of standbys, as measured by the last health check.", metricTypeGauge, []string{"backend"})}
+	metrics.certificateExpiry = GaugeVec{metrics.family("pgproxy_certificate_expiry_timestamp_seconds",
+		"Expiry of the loaded certificates, as a Unix timestamp.", metricTypeGauge, []string{"file"})}
+	return metrics
+}
+
+func (metrics *Metrics) family(name, help, metricType string, labels []string) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		series:     make(map[string]*series),
+	}
+	switch metricType {
+	case metricTypeCounter:
+		f.newMetric = func() metric { return &Counter{} }
+	case metricTypeGauge:
+		f.newMetric = func() metric { return &Gauge{} }
+	}
+	metrics.families = append(metrics.families, f)
+	return f
+}
+
+func (metrics *Metrics) histogramFamily(name, help string, buckets []float64) *family {
+	f := metrics.family(name, help, metricTypeHistogram, poolLabels)
+	f.newMetric = func() metric { return NewHistogram(buckets) }
+	return f
+}
+
+/**
+ * HandshakeFailed counts a client that didn't make it through the startup handshake.
+ *
+ * The reason comes from the error when it tells (see handshakeError), otherwise from the step that failed.
+ * Clients closing the connection on their own, e.g. TCP health probes, count as client_disconnected.
+ */
+func (metrics *Metrics) HandshakeFailed(reason string, err error) {
+	var herr *handshakeError
+	switch {
+	case errors.As(err, &herr):
+		reason = herr.reason
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		reason = HandshakeFailureDisconnected
+	}
+	metrics.HandshakeFailures.With(reason).Inc()
+}
+
+// Pool returns the metrics of a pool's sessions.
+func (metrics *Metrics) Pool(key PoolKey) *PoolMetrics {
+	metrics.pmutex.Lock()
+	defer metrics.pmutex.Unlock()
+	if pool, ok := metrics.pools[key]; ok {
+		return pool
+	}
+	labels := []string{key.Backend, key.Database, key.User}
+	pool := &PoolMetrics{
+		metrics:           metrics,
+		labels:            labels,
+		ClientConnections: metrics.ClientConnections.With(labels...),
+		ClientsTotal:      metrics.ClientConnectionsTotal.With(labels...),
+		BytesToBackend:    metrics.Bytes.With(append(labels, DirectionFrontendToBackend)...),
+		BytesToFrontend:   metrics.Bytes.With(append(labels, DirectionBackendToFrontend)...),
+		QueryDuration:     metrics.QueryDuration.With(labels...),
+		WaitDuration:      metrics.PoolWaitDuration.With(labels...),
+		WaitTimeouts:      metrics.PoolWaitTimeouts.With(labels...),
+	}
+	metrics.pools[key] = pool
+	return pool
+}
+
+// RemovePool drops the metrics of a pool that was removed.
+func (metrics *Metrics) RemovePool(key PoolKey) {
+	metrics.pmutex.Lock()
+	delete(metrics.pools, key)
+	metrics.pmutex.Unlock()
+	labels := []string{key.Backend, key.Database, key.User}
+	for _, f := range []*family{metrics.ClientConnections.family, metrics.ClientConnectionsTotal.family,
+		metrics.Bytes.family, metrics.Queries.family, metrics.QueryErrors.family, metrics.QueryDuration.family,
+		metrics.PoolWaitDuration.family, metrics.PoolWaitTimeouts.family} {
+		f.removePrefix(labels)
+	}
+}
+
+// collect sets the metrics read from the session registry, pools, health checker and certificates.
+func (metrics *Metrics) collect() {
+	if metrics.Sessions != nil {
+		states := make(map[string]int)
+		for _, session := range metrics.Sessions.Info() {
+			states[session.State]++
+		}
+		metrics.clientSessions.reset()
+		for _, state := range SessionStates {
+			metrics.clientSessions.With(state).Set(float64(states[state]))
+		}
+	}
+	if metrics.Pools != nil {
+		metrics.backendConnections.reset()
+		metrics.poolWaiting.reset()
+		for _, pool := range metrics.Pools.Pools() {
+			labels := []string{pool.Key.Backend, pool.Key.Database, pool.Key.User}
+			stats := pool.Stats()
+			metrics.backendConnections.With(append(labels, "idle")...).Set(float64(stats.Idle))
+			metrics.backendConnections.With(append(labels, "active")...).Set(float64(stats.Open - stats.Idle))
+			metrics.poolWaiting.With(labels...).Set(float64(stats.Waiting))
+		}
+	}
+	if metrics.Health != nil {
+		metrics.backendState.reset()
+		metrics.replicationLag.reset()
+		for backend, node := range metrics.Health.States() {
+			for _, state := range []string{NodeStateUp, NodeStateStandby, NodeStateDown, NodeStateUnknown} {
+				value := 0.0
+				if node.State == state {
+					value = 1
+				}
+				metrics.backendState.With(backend, state).Set(value)
+			}
+			if node.State == NodeStateStandby && node.LagKnown {
+				metrics.replicationLag.With(backend).Set(node.Lag.Seconds())
+			}
+		}
+	}
+	if metrics.Certificates != nil {
+		metrics.certificateExpiry.reset()
+		for _, expiry := range metrics.Certificates.Expiry() {
+			metrics.certificateExpiry.With(expiry.File).Set(float64(expiry.NotAfter.Unix()))
+		}
+	}
+}
+
+// Write writes every metric in the Prometheus text format.
+func (metrics *Metrics) Write(w io.Writer) {
+	metrics.scrape.Lock()
+	defer metrics.scrape.Unlock()
+	metrics.collect()
+	for _, f := range metrics.families {
+		f.write(w)
+	}
+}
+
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	metrics.Write(w)
+}
+
+// PoolMetrics holds the series of one pool, so sessions don't look them up per message.
+type PoolMetrics struct {
+	metrics           *Metrics
+	labels            []string
+	ClientConnections *Gauge
+	ClientsTotal      *Counter
+	BytesToBackend    *Counter
+	BytesToFrontend   *Counter
+	QueryDuration     *Histogram
+	WaitDuration      *Histogram
+	WaitTimeouts      *Counter
+}
+
+// Frontend counts a message relayed from the frontend.
+func (pool *PoolMetrics) Frontend(msg []byte) {
+	pool.BytesToBackend.Add(uint64(len(msg)))
+}
+
+// Backend counts a message relayed from the backend: completed commands and errors.
+func (pool *PoolMetrics) Backend(msg []byte) {
+	pool.BytesToFrontend.Add(uint64(len(msg)))
+	switch GetMessageType(msg) {
+	case MessageTypeCommandComplete:
+		if tag, err := GetCommandTag(msg); err == nil {
+			pool.metrics.Queries.With(append(pool.labels, CommandTagName(tag))...).Inc()
+		}
+	case MessageTypeErrorResponse:
+		pool.metrics.QueryErrors.With(append(pool.labels, GetErrorResponse(msg).Code)...).Inc()
+	}
+}
+
+// handshakeError tells HandshakeFailed why a handshake failed.
+type handshakeError struct {
+	reason string
+	err    error
+}
+
+func (e *handshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+func formatLabel(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
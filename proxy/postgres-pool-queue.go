@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/**
+ * Pool wait queue
+ *
+ * When a pool has reached max_size, clients wait for a connection instead of the proxy opening more.
+ * Connections are handed to the waiter with the highest priority class. Within a class, tenants are served
+ * in turn (the tenant served longest ago goes first) so one busy service can't starve the others, and
+ * each tenant's waiters are served in arrival order. A client waiting longer than wait_timeout
+ * receives SQLSTATE 53300.
+ */
+
+const (
+	FairnessKeyUser            = "user"
+	FairnessKeyApplicationName = "application_name"
+)
+
+// PoolRequest identifies the client asking for a backend connection.
+type PoolRequest struct {
+	User            string
+	ApplicationName string
+	// Span the backend dial is traced under, if any
+	Span *Span
+}
+
+type waiter struct {
+	tenant   string
+	priority int
+	sequence uint64
+	// Receives an idle connection, or nil when the waiter may dial a new one
+	ready chan *PGConnection
+}
+
+type PoolStats struct {
+	Open     int
+	Idle     int
+	Waiting  int
+	Waits    uint64
+	Timeouts uint64
+	// Total and longest time spent in the wait queue
+	WaitTime    time.Duration
+	MaxWaitTime time.Duration
+}
+
+func (pool *Pool) tenant(request PoolRequest) string {
+	if pool.config.FairnessKey == FairnessKeyApplicationName {
+		return request.ApplicationName
+	}
+	return request.User
+}
+
+// priority returns the priority class of the first matching rule, 0 when none matches.
+func (pool *Pool) priority(request PoolRequest) int {
+	for _, rule := range pool.config.Priorities {
+		if matchAttribute(rule.User, request.User) && matchAttribute(rule.ApplicationName, request.ApplicationName) {
+			return rule.Priority
+		}
+	}
+	return 0
+}
+
+/**
+ * wait queues the client until a connection is handed over or wait_timeout passes.
+ *
+ * A nil connection without error hands over a free slot: the open count already includes it
+ * and the caller dials. wait is called with the pool mutex held and returns with it released.
+ */
+func (pool *Pool) wait(request PoolRequest) (*PGConnection, error) {
+	if pool.config.WaitTimeout.Duration <= 0 ||
+		(pool.config.MaxWaiting > 0 && len(pool.waiters) >= pool.config.MaxWaiting) {
+		pool.mutex.Unlock()
+		return nil, fmt.Errorf("%w: pool %v reached max_size %d", ErrPoolExhausted, pool.Key, pool.config.MaxSize)
+	}
+	pool.sequence++
+	w := &waiter{
+		tenant:   pool.tenant(request),
+		priority: pool.priority(request),
+		sequence: pool.sequence,
+		ready:    make(chan *PGConnection, 1),
+	}
+	pool.waiters = append(pool.waiters, w)
+	pool.mutex.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(pool.config.WaitTimeout.Duration)
+	defer timer.Stop()
+	select {
+	case pg := <-w.ready:
+		pool.recordWait(time.Since(start), false)
+		return pg, nil
+	case <-timer.C:
+		pool.mutex.Lock()
+		removed := pool.removeWaiter(w)
+		pool.mutex.Unlock()
+		if !removed {
+			// A connection was handed over while timing out
+			pool.recordWait(time.Since(start), false)
+			return <-w.ready, nil
+		}
+		pool.recordWait(time.Since(start), true)
+		return nil, fmt.Errorf("%w: timed out after %v waiting for pool %v", ErrPoolExhausted,
+			pool.config.WaitTimeout.Duration, pool.Key)
+	}
+}
+
+func (pool *Pool) removeWaiter(w *waiter) bool {
+	for i, other := range pool.waiters {
+		if other == w {
+			pool.waiters = append(pool.waiters[:i], pool.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// next removes and returns the waiter to serve next, nil when nobody waits. Called with the pool mutex held.
+func (pool *Pool) next() *waiter {
+	var best *waiter
+	for _, w := range pool.waiters {
+		if best == nil || w.priority > best.priority ||
+			(w.priority == best.priority && pool.before(w, best)) {
+			best = w
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	pool.removeWaiter(best)
+	pool.served++
+	pool.tenantServed[best.tenant] = pool.served
+	if len(pool.waiters) == 0 {
+		pool.tenantServed = make(map[string]uint64)
+	}
+	return best
+}
+
+// before orders waiters of the same priority class: least recently served tenant first, then arrival order.
+func (pool *Pool) before(w, other *waiter) bool {
+	if w.tenant != other.tenant {
+		served, otherServed := pool.tenantServed[w.tenant], pool.tenantServed[other.tenant]
+		if served != otherServed {
+			return served < otherServed
+		}
+	}
+	return w.sequence < other.sequence
+}
+
+func (pool *Pool) recordWait(wait time.Duration, timeout bool) {
+	pool.metrics.WaitDuration.ObserveDuration(wait)
+	if timeout {
+		pool.metrics.WaitTimeouts.Inc()
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.stats.Waits++
+	pool.stats.WaitTime += wait
+	if wait > pool.stats.MaxWaitTime {
+		pool.stats.MaxWaitTime = wait
+	}
+	if timeout {
+		pool.stats.Timeouts++
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPoolWaitQueueOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		// Waiters arriving, named by their tenant and a number, with an optional ":priority",
+		// and "-" for a connection handed to the next waiter
+		events string
+		served string
+	}{
+		{name: "nobody waits", events: "-", served: ""},
+		{name: "arrival order", events: "a1 a2 a3 - - -", served: "a1 a2 a3"},
+		{name: "tenants take turns", events: "a1 a2 a3 b1 - - - -", served: "a1 b1 a2 a3"},
+		{name: "tenant arriving after another was served", events: "a1 a2 - b1 - -", served: "a1 b1 a2"},
+		{name: "higher priority first", events: "a1 b1:1 - -", served: "b1 a1"},
+		{name: "priority before tenant turns", events: "a1 a2:1 b1 - - -", served: "a2 b1 a1"},
+		{name: "turns within a priority class", events: "a1:1 a2:1 b1:1 c1 - - - -", served: "a1 b1 a2 c1"},
+		{name: "turns restart when the queue empties", events: "b1 - a1 - a2 b2 - -", served: "b1 a1 a2 b2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := &Pool{tenantServed: make(map[string]uint64)}
+			names := make(map[*waiter]string)
+			var served []string
+			for _, event := range strings.Fields(test.events) {
+				if event == "-" {
+					if w := pool.next(); w != nil {
+						served = append(served, names[w])
+					}
+					continue
+				}
+				name, priority, _ := strings.Cut(event, ":")
+				w := &waiter{tenant: name[:1], sequence: pool.sequence}
+				if priority != "" {
+					var err error
+					if w.priority, err = strconv.Atoi(priority); err != nil {
+						t.Fatal(err)
+					}
+				}
+				pool.sequence++
+				pool.waiters = append(pool.waiters, w)
+				names[w] = name
+			}
+			if order := strings.Join(served, " "); order != test.served {
+				t.Errorf("served %q, want %q", order, test.served)
+			}
+		})
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+ * Backend connection pooling
+ *
+ * Authenticated backend connections are kept per (backend, user, database).
+ * In session mode a connection is handed to a client for the lifetime of its session; on release it is reset
+ * with the configured reset query and returned to the pool, unless the client left it in an unknown state.
+ * In transaction mode a connection is only handed out for the duration of a transaction.
+ *
+ * Pools are created on first use, up to max_pools. A pool without sessions and connections in use that wasn't
+ * handed out for PoolRemoveAfter is closed and removed, with its metrics.
+ */
+
+const (
+	PoolModeSession     = "session"
+	PoolModeTransaction = "transaction"
+)
+
+const PoolMaintenanceInterval = 5 * time.Second
+
+// How long an unused pool is kept
+const PoolRemoveAfter = time.Minute
+
+var ErrPoolExhausted = errors.New("no more connections allowed")
+
+var ErrTooManyPools = errors.New("too many pools")
+
+type PoolKey struct {
+	Backend  string
+	User     string
+	Database string
+}
+
+func (key PoolKey) String() string {
+	return fmt.Sprintf("%v/%v@%v", key.User, key.Database, key.Backend)
+}
+
+type Pool struct {
+	Key    PoolKey
+	config PoolConfig
+	// Template for new backend connections
+	route  *Route
+	mutex  sync.Mutex
+	idle   []*PGConnection
+	open   int
+	closed bool
+	// Clients waiting for a connection, and the fairness bookkeeping of the queue
+	waiters      []*waiter
+	sequence     uint64
+	served       uint64
+	tenantServed map[string]uint64
+	stats        PoolStats
+	// ParameterStatus values reported by the last connection dialed
+	parameters map[string]string
+	metrics    *PoolMetrics
+	manager    *PoolManager
+	// Sessions using the pool (see PoolManager.Join) and when the pool was last handed out
+	sessions  int
+	handedOut time.Time
+}
+
+type PoolManager struct {
+	config  *Config
+	metrics *Metrics
+	mutex   sync.Mutex
+	pools   map[PoolKey]*Pool
+	// Closed on RESUME, nil unless the admin console paused the pools
+	resumed chan struct{}
+}
+
+func NewPoolManager(config *Config, metrics *Metrics) *PoolManager {
+	return &PoolManager{
+		config:  config,
+		metrics: metrics,
+		pools:   make(map[PoolKey]*Pool),
+	}
+}
+
+// Pool returns the pool for a route, creating it on first use. It fails with ErrTooManyPools at max_pools.
+func (manager *PoolManager) Pool(route *Route) (*Pool, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return manager.pool(route)
+}
+
+// pool implements Pool, called with the manager mutex held.
+func (manager *PoolManager) pool(route *Route) (*Pool, error) {
+	key := PoolKey{Backend: route.BackendName, User: route.Username, Database: route.Database}
+	pool, ok := manager.pools[key]
+	if !ok {
+		if len(manager.pools) >= manager.config.MaxPools {
+			return nil, fmt.Errorf("%w: %d pools exist, none for %v", ErrTooManyPools, len(manager.pools), key)
+		}
+		pool = &Pool{
+			Key:          key,
+			config:       manager.config.PoolConfig(route.Backend),
+			route:        route,
+			tenantServed: make(map[string]uint64),
+			metrics:      manager.metrics.Pool(key),
+			manager:      manager,
+		}
+		manager.pools[key] = pool
+		go pool.maintain()
+	}
+	pool.mutex.Lock()
+	pool.handedOut = time.Now()
+	pool.mutex.Unlock()
+	return pool, nil
+}
+
+// Join returns the pool for a route to a session, which keeps it from being removed until it calls Leave.
+func (manager *PoolManager) Join(route *Route) (*Pool, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	pool, err := manager.pool(route)
+	if err != nil {
+		return nil, err
+	}
+	pool.mutex.Lock()
+	pool.sessions++
+	pool.mutex.Unlock()
+	return pool, nil
+}
+
+// Leave ends a session's use of the pool, see Join.
+func (pool *Pool) Leave() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.sessions--
+}
+
+/**
+ * remove closes and forgets a pool that has no sessions, connections in use or waiters and wasn't handed out
+ * for PoolRemoveAfter. It reports whether the pool was removed.
+ */
+func (manager *PoolManager) remove(pool *Pool) bool {
+	manager.mutex.Lock()
+	pool.mutex.Lock()
+	unused := pool.sessions == 0 && pool.open == len(pool.idle) && len(pool.waiters) == 0 &&
+		time.Since(pool.handedOut) > PoolRemoveAfter && manager.pools[pool.Key] == pool
+	pool.mutex.Unlock()
+	if unused {
+		delete(manager.pools, pool.Key)
+		manager.metrics.RemovePool(pool.Key)
+	}
+	manager.mutex.Unlock()
+	if unused {
+		pool.Close()
+	}
+	return unused
+}
+
+// Pools returns a snapshot of all pools.
+func (manager *PoolManager) Pools() (pools []*Pool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for _, pool := range manager.pools {
+		pools = append(pools, pool)
+	}
+	return
+}
+
+// Drain closes the idle connections of every pool of a backend, e.g. when it stopped being the primary.
+func (manager *PoolManager) Drain(backend string) {
+	for _, pool := range manager.Pools() {
+		if pool.Key.Backend == backend {
+			pool.DiscardIdle()
+		}
+	}
+}
+
+// InUse returns the number of connections of a backend handed out to clients, of every backend when empty.
+func (manager *PoolManager) InUse(backend string) (n int) {
+	for _, pool := range manager.Pools() {
+		if backend == "" || pool.Key.Backend == backend {
+			stats := pool.Stats()
+			n += stats.Open - stats.Idle
+		}
+	}
+	return
+}
+
+/**
+ * Pause stops handing out backend connections: sessions that need one wait until Resume.
+ * Connections already handed out stay with their sessions until released. Pause reports false
+ * when the pools are paused already.
+ */
+func (manager *PoolManager) Pause() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.resumed != nil {
+		return false
+	}
+	manager.resumed = make(chan struct{})
+	return true
+}
+
+// Resume lets the sessions waiting on Pause go on. It reports false when the pools are not paused.
+func (manager *PoolManager) Resume() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.resumed == nil {
+		return false
+	}
+	close(manager.resumed)
+	manager.resumed = nil
+	return true
+}
+
+// Resumed returns a channel closed when the pools resume, nil when they are not paused.
+func (manager *PoolManager) Resumed() <-chan struct{} {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	return manager.resumed
+}
+
+func (manager *PoolManager) Close() {
+	manager.Resume()
+	for _, pool := range manager.Pools() {
+		pool.Close()
+	}
+}
+
+/**
+ * Acquire returns an idle connection from the pool or dials a new one when the pool is below its maximum size.
+ *
+ * When the pool is full the client waits in the pool's queue (see postgres-pool-queue.go).
+ * Idle connections past their lifetime, or failing the validation query, are discarded.
+ */
+func (pool *Pool) Acquire(request PoolRequest) (*PGConnection, error) {
+	for {
+		pool.mutex.Lock()
+		if pool.closed {
+			pool.mutex.Unlock()
+			return nil, fmt.Errorf("pool %v is closed", pool.Key)
+		}
+		var pg *PGConnection
+		if n := len(pool.idle); n > 0 {
+			pg = pool.idle[n-1]
+			pool.idle = pool.idle[:n-1]
+			pool.mutex.Unlock()
+		} else if pool.open < pool.config.MaxSize {
+			pool.open++
+			pool.mutex.Unlock()
+		} else {
+			var err error
+			if pg, err = pool.wait(request); err != nil {
+				return nil, err
+			}
+		}
+		if pg == nil {
+			return pool.dial(request)
+		}
+		if pool.expired(pg) || !pool.validate(pg) {
+			pool.discard(pg)
+			continue
+		}
+		pg.lastUsed = time.Now()
+		return pg, nil
+	}
+}
+
+func (pool *Pool) dial(request PoolRequest) (*PGConnection, error) {
+	pg := NewBackendConnection(pool.route, request.ApplicationName)
+	pg.pool = pool
+	span := request.Span.Child("backend dial", SpanKindClient, time.Now())
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("server.address", pool.route.Backend.Address)
+	err := pg.Dial(pool.route.Backend.Address)
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.End()
+	if err != nil {
+		pool.mutex.Lock()
+		pool.free()
+		pool.mutex.Unlock()
+		return nil, err
+	}
+	parameters := make(map[string]string)
+	for name, value := range pg.parameters {
+		parameters[name] = value
+	}
+	pool.mutex.Lock()
+	pool.parameters = parameters
+	pool.mutex.Unlock()
+	return pg, nil
+}
+
+// Parameters returns the ParameterStatus values of the backend, or nil before the first connection is made.
+func (pool *Pool) Parameters() map[string]string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.parameters
+}
+
+/**
+ * Release returns a connection to the pool.
+ *
+ * A connection that is not idle (the client disconnected mid-transaction or mid-query), has outlived
+ * max_lifetime or fails the reset query is closed instead. The reset query only runs in session mode.
+ */
+func (pool *Pool) Release(pg *PGConnection, idle bool) {
+	if !idle || pool.expired(pg) {
+		pool.discard(pg)
+		return
+	}
+	if pool.config.ResetQuery != "" && pool.Mode() == PoolModeSession {
+		if err := pg.Exec(pool.config.ResetQuery); err != nil {
+			log.Printf("pool %v: reset query failed: %v", pool.Key, err)
+			pool.discard(pg)
+			return
+		}
+		pg.prepared = nil
+	}
+	pool.put(pg)
+}
+
+func (pool *Pool) put(pg *PGConnection) {
+	pg.lastUsed = time.Now()
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		pool.discard(pg)
+		return
+	}
+	if w := pool.next(); w != nil {
+		w.ready <- pg
+	} else {
+		pool.idle = append(pool.idle, pg)
+	}
+	pool.mutex.Unlock()
+}
+
+func (pool *Pool) discard(pg *PGConnection) {
+	_ = pg.sendTerminate()
+	_ = pg.Close()
+	pool.mutex.Lock()
+	pool.free()
+	pool.mutex.Unlock()
+}
+
+// free gives up a connection slot, letting the next waiter dial in its place. Called with the pool mutex held.
+func (pool *Pool) free() {
+	if w := pool.next(); w != nil && !pool.closed {
+		w.ready <- nil
+		return
+	}
+	pool.open--
+}
+
+func (pool *Pool) expired(pg *PGConnection) bool {
+	return pool.config.MaxLifetime.Duration > 0 && time.Since(pg.createdAt) > pool.config.MaxLifetime.Duration
+}
+
+func (pool *Pool) validate(pg *PGConnection) bool {
+	if pool.config.ValidationQuery == "" {
+		return true
+	}
+	if err := pg.Exec(pool.config.ValidationQuery); err != nil {
+		log.Printf("pool %v: validation query failed: %v", pool.Key, err)
+		return false
+	}
+	return true
+}
+
+func (pool *Pool) Mode() string {
+	if pool.config.Mode == "" {
+		return PoolModeSession
+	}
+	return pool.config.Mode
+}
+
+func (pool *Pool) Stats() PoolStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	stats := pool.stats
+	stats.Open, stats.Idle, stats.Waiting = pool.open, len(pool.idle), len(pool.waiters)
+	return stats
+}
+
+// IdleConnections returns a snapshot of the connections waiting in the pool.
+func (pool *Pool) IdleConnections() []*PGConnection {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return append([]*PGConnection{}, pool.idle...)
+}
+
+func (pool *Pool) DiscardIdle() {
+	pool.mutex.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.mutex.Unlock()
+	for _, pg := range idle {
+		pool.discard(pg)
+	}
+}
+
+func (pool *Pool) Close() {
+	pool.mutex.Lock()
+	pool.closed = true
+	idle := pool.idle
+	pool.idle = nil
+	pool.mutex.Unlock()
+	for _, pg := range idle {
+		pool.discard(pg)
+	}
+}
+
+/**
+ * maintain closes idle connections past idle_timeout or max_lifetime and keeps min_size connections open.
+ * It ends when the pool is closed or removed as unused.
+ */
+func (pool *Pool) maintain() {
+	ticker := time.NewTicker(PoolMaintenanceInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if pool.manager.remove(pool) {
+			log.Printf("pool %v: removed, unused for %v", pool.Key, PoolRemoveAfter)
+			return
+		}
+		pool.mutex.Lock()
+		if pool.closed {
+			pool.mutex.Unlock()
+			return
+		}
+		var stale []*PGConnection
+		idle := pool.idle[:0]
+		for _, pg := range pool.idle {
+			idleTooLong := pool.config.IdleTimeout.Duration > 0 && time.Since(pg.lastUsed) > pool.config.IdleTimeout.Duration &&
+				pool.open-len(stale) > pool.config.MinSize
+			if idleTooLong || pool.expired(pg) {
+				stale = append(stale, pg)
+				continue
+			}
+			idle = append(idle, pg)
+		}
+		pool.idle = idle
+		missing := pool.config.MinSize - (pool.open - len(stale))
+		if waiting := len(pool.waiters); waiting > 0 {
+			log.Printf("pool %v: %d clients waiting, %d connections open", pool.Key, waiting, pool.open)
+		}
+		pool.mutex.Unlock()
+
+		for _, pg := range stale {
+			pool.discard(pg)
+		}
+		for i := 0; i < missing; i++ {
+			pool.mutex.Lock()
+			pool.open++
+			pool.mutex.Unlock()
+			pg, err := pool.dial(PoolRequest{})
+			if err != nil {
+				log.Printf("pool %v: %v", pool.Key, err)
+				break
+			}
+			pool.put(pg)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+ * Prepared statements in transaction mode
+ *
+ * A client's named prepared statements only exist on the backend connection where they were parsed,
+ * but in transaction mode the client moves between backend connections.
+ *
+ * The proxy keeps the Parse of every named statement of the client, and each backend connection keeps
+ * the statements already prepared on it under proxy-assigned names. Parse, Bind, Describe and Close
+ * are rewritten to the proxy-assigned names, and a statement is parsed again on a backend that doesn't have it.
+ *
+ * Skipped requests are answered by the proxy and injected requests are hidden from the client. To keep
+ * the responses in order, every request sent to the backend is queued until the backend answers it.
+ *
+ * A Parse reusing the name of a statement of the client fails with 42P05 as on the backend, and like the backend
+ * the proxy then discards the client's messages up to Sync. Unlike the backend, it doesn't abort a transaction.
+ *
+ * DISCARD ALL and DEALLOCATE ALL drop the statements of both the client and the backend. A DEALLOCATE of a
+ * single statement of the client is rewritten to its proxy-assigned name, when it is the only statement of
+ * the query or of an unnamed Parse.
+ */
+
+const PreparedStatementPrefix = "pgproxy_"
+
+var preparedStatementCounter uint64
+
+type PreparedStatement struct {
+	Query         string
+	ParameterOIDs []int32
+}
+
+// Key identifies statements with the same query and parameter types, which can share a backend statement.
+func (statement *PreparedStatement) Key() string {
+	hash := sha256.New()
+	hash.Write([]byte(statement.Query))
+	for _, oid := range statement.ParameterOIDs {
+		_ = binary.Write(hash, binary.BigEndian, oid)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// pendingResponse is a request sent to the backend (or answered by the proxy) that awaits its response.
+type pendingResponse struct {
+	request byte
+	// Response sent by the proxy instead of the backend
+	synthetic []byte
+	// The backend's response is not forwarded, the request was injected by the proxy
+	suppress bool
+	// Key of the statement prepared by this Parse
+	statement string
+	// Name of the client statement this Parse creates, forgotten again when the Parse fails
+	name string
+	// Response sent instead of the backend's EmptyQueryResponse, the query was emptied by the proxy
+	replace []byte
+}
+
+type StatementTracker struct {
+	mutex      sync.Mutex
+	statements map[string]*PreparedStatement
+	pending    []*pendingResponse
+	// The proxy answered a request with an error, frontend messages are discarded up to Sync
+	failed bool
+}
+
+func NewStatementTracker() *StatementTracker {
+	return &StatementTracker{
+		statements: make(map[string]*PreparedStatement),
+	}
+}
+
+/**
+ * Frontend rewrites a frontend message for the backend connection pg.
+ *
+ * It returns the messages to send to the backend. Responses the proxy answers itself are
+ * written to the frontend once every earlier response has been delivered.
+ */
+func (tracker *StatementTracker) Frontend(pg, frontend *PGConnection, msg []byte) (messages [][]byte, err error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if pg.prepared == nil {
+		pg.prepared = make(map[string]string)
+	}
+	if tracker.failed {
+		if GetMessageType(msg) != MessageTypeSync {
+			return nil, nil
+		}
+		tracker.failed = false
+	}
+
+	switch GetMessageType(msg) {
+	case MessageTypeParse:
+		messages, err = tracker.parse(pg, msg)
+	case MessageTypeBind:
+		messages, err = tracker.bind(pg, msg)
+	case MessageTypeDescribe:
+		messages, err = tracker.describe(pg, msg)
+	case MessageTypeClose:
+		messages, err = tracker.close(pg, msg)
+	case MessageTypeQuery:
+		messages, err = tracker.query(pg, msg)
+	case MessageTypeExecute, MessageTypeSync, MessageTypeFunctionCall:
+		tracker.expect(GetMessageType(msg))
+		messages = [][]byte{msg}
+	default:
+		messages = [][]byte{msg}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return messages, tracker.flush(frontend)
+}
+
+func (tracker *StatementTracker) parse(pg *PGConnection, msg []byte) ([][]byte, error) {
+	name, query, parameterOIDs, err := GetParseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		statements := lexStatements(query)
+		tracker.discard(pg, statements)
+		if deallocated, ok := tracker.deallocated(query, statements); ok {
+			serverName, messages, err := tracker.serverStatement(pg, deallocated)
+			if err != nil {
+				return nil, err
+			}
+			tracker.deallocate(pg, deallocated)
+			parse, err := CreateParseMessage("", "DEALLOCATE "+serverName, parameterOIDs)
+			if err != nil {
+				return nil, err
+			}
+			tracker.expect(MessageTypeParse)
+			return append(messages, parse), nil
+		}
+		tracker.expect(MessageTypeParse)
+		return [][]byte{msg}, nil
+	}
+	if _, ok := tracker.statements[name]; ok {
+		errorResponse, err := ErrorResponseMessage(ErrorSeverityError, SQLStateDuplicatePrepared,
+			fmt.Sprintf("prepared statement %q already exists", name))
+		if err != nil {
+			return nil, err
+		}
+		tracker.pending = append(tracker.pending, &pendingResponse{request: MessageTypeParse, synthetic: errorResponse})
+		tracker.failed = true
+		return nil, nil
+	}
+	statement := &PreparedStatement{Query: query, ParameterOIDs: parameterOIDs}
+	tracker.statements[name] = statement
+	if _, ok := pg.prepared[statement.Key()]; ok {
+		complete, err := CompleteMessage(MessageTypeParseComplete)
+		if err != nil {
+			return nil, err
+		}
+		tracker.pending = append(tracker.pending, &pendingResponse{request: MessageTypeParse, synthetic: complete})
+		return nil, nil
+	}
+	parse, err := tracker.prepare(pg, statement, false)
+	if err != nil {
+		return nil, err
+	}
+	tracker.pending[len(tracker.pending)-1].name = name
+	return [][]byte{parse}, nil
+}
+
+// prepare parses the statement on the backend under a new proxy-assigned name.
+func (tracker *StatementTracker) prepare(pg *PGConnection, statement *PreparedStatement, suppress bool) ([]byte, error) {
+	key := statement.Key()
+	serverName := fmt.Sprintf("%v%d", PreparedStatementPrefix, atomic.AddUint64(&preparedStatementCounter, 1))
+	parse, err := CreateParseMessage(serverName, statement.Query, statement.ParameterOIDs)
+	if err != nil {
+		return nil, err
+	}
+	pg.prepared[key] = serverName
+	tracker.pending = append(tracker.pending, &pendingResponse{request: MessageTypeParse, suppress: suppress, statement: key})
+	return parse, nil
+}
+
+// serverStatement returns the backend name of a client statement and the Parse to inject when it isn't prepared yet.
+func (tracker *StatementTracker) serverStatement(pg *PGConnection, name string) (serverName string, messages [][]byte, err error) {
+	statement, ok := tracker.statements[name]
+	if !ok {
+		// Let the backend report the missing statement
+		return name, nil, nil
+	}
+	if serverName, ok = pg.prepared[statement.Key()]; ok {
+		return serverName, nil, nil
+	}
+	parse, err := tracker.prepare(pg, statement, true)
+	if err != nil {
+		return
+	}
+	return pg.prepared[statement.Key()], [][]byte{parse}, nil
+}
+
+func (tracker *StatementTracker) bind(pg *PGConnection, msg []byte) ([][]byte, error) {
+	portal, name, parameters, err := GetBindMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		tracker.expect(MessageTypeBind)
+		return [][]byte{msg}, nil
+	}
+	serverName, messages, err := tracker.serverStatement(pg, name)
+	if err != nil {
+		return nil, err
+	}
+	bind, err := CreateBindMessage(portal, serverName, parameters)
+	if err != nil {
+		return nil, err
+	}
+	tracker.expect(MessageTypeBind)
+	return append(messages, bind), nil
+}
+
+func (tracker *StatementTracker) describe(pg *PGConnection, msg []byte) ([][]byte, error) {
+	target, name, err := GetTarget(msg)
+	if err != nil {
+		return nil, err
+	}
+	if target != TargetPreparedStatement || name == "" {
+		tracker.expect(MessageTypeDescribe)
+		return [][]byte{msg}, nil
+	}
+	serverName, messages, err := tracker.serverStatement(pg, name)
+	if err != nil {
+		return nil, err
+	}
+	describe, err := CreateTargetMessage(MessageTypeDescribe, target, serverName)
+	if err != nil {
+		return nil, err
+	}
+	tracker.expect(MessageTypeDescribe)
+	return append(messages, describe), nil
+}
+
+func (tracker *StatementTracker) close(pg *PGConnection, msg []byte) ([][]byte, error) {
+	target, name, err := GetTarget(msg)
+	if err != nil {
+		return nil, err
+	}
+	statement, ok := tracker.statements[name]
+	if target != TargetPreparedStatement || name == "" || !ok {
+		tracker.expect(MessageTypeClose)
+		return [][]byte{msg}, nil
+	}
+	delete(tracker.statements, name)
+	key := statement.Key()
+	serverName, prepared := pg.prepared[key]
+	if !prepared {
+		complete, err := CompleteMessage(MessageTypeCloseComplete)
+		if err != nil {
+			return nil, err
+		}
+		tracker.pending = append(tracker.pending, &pendingResponse{request: MessageTypeClose, synthetic: complete})
+		return nil, nil
+	}
+	delete(pg.prepared, key)
+	closeMessage, err := CreateTargetMessage(MessageTypeClose, target, serverName)
+	if err != nil {
+		return nil, err
+	}
+	tracker.expect(MessageTypeClose)
+	return [][]byte{closeMessage}, nil
+}
+
+/**
+ * query follows the statements a Query drops.
+ *
+ * A DEALLOCATE of a statement that isn't prepared on this backend is sent as an empty query, whose
+ * EmptyQueryResponse is answered with the CommandComplete of DEALLOCATE.
+ */
+func (tracker *StatementTracker) query(pg *PGConnection, msg []byte) ([][]byte, error) {
+	query := GetQuery(msg)
+	statements := lexStatements(query)
+	tracker.discard(pg, statements)
+	name, ok := tracker.deallocated(query, statements)
+	if !ok {
+		tracker.expect(MessageTypeQuery)
+		return [][]byte{msg}, nil
+	}
+	pending := &pendingResponse{request: MessageTypeQuery}
+	rewritten := ""
+	if serverName, prepared := pg.prepared[tracker.statements[name].Key()]; prepared {
+		rewritten = "DEALLOCATE " + serverName
+	} else {
+		complete, err := CommandCompleteMessage("DEALLOCATE")
+		if err != nil {
+			return nil, err
+		}
+		pending.replace = complete
+	}
+	tracker.deallocate(pg, name)
+	message, err := CreateQueryMessage(rewritten)
+	if err != nil {
+		return nil, err
+	}
+	tracker.pending = append(tracker.pending, pending)
+	return [][]byte{message}, nil
+}
+
+// discard forgets every statement of the client and of the backend after DISCARD ALL or DEALLOCATE ALL.
+func (tracker *StatementTracker) discard(pg *PGConnection, statements [][]string) {
+	for _, words := range statements {
+		words = withoutPrepare(words)
+		if len(words) == 2 && (words[0] == "DISCARD" || words[0] == "DEALLOCATE") && words[1] == "ALL" {
+			tracker.statements = make(map[string]*PreparedStatement)
+			pg.prepared = make(map[string]string)
+			return
+		}
+	}
+}
+
+/**
+ * deallocated returns the client statement a query deallocates by name, if it is the query's only statement.
+ *
+ * Statement names are folded to lower case like unquoted identifiers, quoted names are left to the backend.
+ */
+func (tracker *StatementTracker) deallocated(query string, statements [][]string) (string, bool) {
+	if len(statements) != 1 || strings.ContainsRune(query, '"') {
+		return "", false
+	}
+	words := statements[0]
+	words = withoutPrepare(words)
+	if len(words) != 2 || words[0] != "DEALLOCATE" || words[1] == "ALL" {
+		return "", false
+	}
+	name := strings.ToLower(words[1])
+	_, ok := tracker.statements[name]
+	return name, ok
+}
+
+// withoutPrepare drops the optional PREPARE of DEALLOCATE PREPARE.
+func withoutPrepare(words []string) []string {
+	if len(words) == 3 && words[0] == "DEALLOCATE" && words[1] == "PREPARE" {
+		return []string{words[0], words[2]}
+	}
+	return words
+}
+
+// deallocate forgets a client statement and its backend statement.
+func (tracker *StatementTracker) deallocate(pg *PGConnection, name string) {
+	delete(pg.prepared, tracker.statements[name].Key())
+	delete(tracker.statements, name)
+}
+
+// Query returns the query text of a named statement of the client.
+func (tracker *StatementTracker) Query(name string) (string, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	statement, ok := tracker.statements[name]
+	if !ok {
+		return "", false
+	}
+	return statement.Query, true
+}
+
+func (tracker *StatementTracker) expect(request byte) {
+	tracker.pending = append(tracker.pending, &pendingResponse{request: request})
+}
+
+/**
+ * Backend forwards a backend message to the frontend, together with the responses the proxy
+ * answered itself that are next in line. Responses to injected requests are dropped.
+ */
+func (tracker *StatementTracker) Backend(pg, frontend *PGConnection, msg []byte) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	forward := true
+	if len(tracker.pending) > 0 {
+		head := tracker.pending[0]
+		switch messageType := GetMessageType(msg); {
+		case messageType == MessageTypeErrorResponse && isExtendedRequest(head.request):
+			// The backend skips every message up to Sync after an error in the extended protocol
+			tracker.pending = tracker.pending[1:]
+			tracker.forget(pg, head)
+			for len(tracker.pending) > 0 && tracker.pending[0].request != MessageTypeSync {
+				tracker.forget(pg, tracker.pending[0])
+				tracker.pending = tracker.pending[1:]
+			}
+		case messageType == MessageTypeEmptyQueryResponse && head.replace != nil:
+			msg = head.replace
+		case completes(head.request, messageType):
+			tracker.pending = tracker.pending[1:]
+			forward = !head.suppress
+		}
+	}
+	if forward {
+		if packet := frontend.SendMessage(msg); packet.Error != nil {
+			return packet.Error
+		}
+	}
+	return tracker.flush(frontend)
+}
+
+// forget removes the backend statement of a Parse that was skipped or failed, and the client statement it created.
+func (tracker *StatementTracker) forget(pg *PGConnection, pending *pendingResponse) {
+	if pending.statement != "" {
+		delete(pg.prepared, pending.statement)
+	}
+	if statement, ok := tracker.statements[pending.name]; ok && pending.name != "" && statement.Key() == pending.statement {
+		delete(tracker.statements, pending.name)
+	}
+}
+
+// flush writes the responses answered by the proxy that are at the head of the queue.
+func (tracker *StatementTracker) flush(frontend *PGConnection) error {
+	for len(tracker.pending) > 0 && tracker.pending[0].synthetic != nil {
+		if packet := frontend.SendMessage(tracker.pending[0].synthetic); packet.Error != nil {
+			return packet.Error
+		}
+		tracker.pending = tracker.pending[1:]
+	}
+	return nil
+}
+
+// Reset drops the queue when the backend connection is detached or lost.
+func (tracker *StatementTracker) Reset() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.pending = nil
+	tracker.failed = false
+}
+
+func isExtendedRequest(request byte) bool {
+	switch request {
+	case MessageTypeParse, MessageTypeBind, MessageTypeDescribe, MessageTypeExecute, MessageTypeClose:
+		return true
+	}
+	return false
+}
+
+// completes reports whether a backend message is the last response to a request.
+func completes(request byte, response byte) bool {
+	switch request {
+	case MessageTypeParse:
+		return response == MessageTypeParseComplete
+	case MessageTypeBind:
+		return response == MessageTypeBindComplete
+	case MessageTypeClose:
+		return response == MessageTypeCloseComplete
+	case MessageTypeDescribe:
+		return response == MessageTypeRowDescription || response == MessageTypeNoData
+	case MessageTypeExecute:
+		return response == MessageTypeCommandComplete || response == MessageTypeEmptyQueryResponse ||
+			response == MessageTypePortalSuspended
+	case MessageTypeSync, MessageTypeQuery, MessageTypeFunctionCall:
+		return response == MessageTypeReadyForQuery
+	}
+	return false
+}
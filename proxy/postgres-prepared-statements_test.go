@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// recordingConn keeps what is written to it.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (conn *recordingConn) Write(b []byte) (int, error) {
+	return conn.written.Write(b)
+}
+
+// describeMessages describes each message in a stream of typed messages by its type and names.
+func describeMessages(t *testing.T, stream []byte) (messages []string) {
+	for len(stream) > 0 {
+		if len(stream) < 5 {
+			t.Fatalf("truncated message %q", stream)
+		}
+		msg := stream[:1+binary.BigEndian.Uint32(stream[1:5])]
+		stream = stream[len(msg):]
+		messages = append(messages, describeMessage(t, msg))
+	}
+	return messages
+}
+
+func describeMessage(t *testing.T, msg []byte) string {
+	var err error
+	description := string(GetMessageType(msg))
+	switch GetMessageType(msg) {
+	case MessageTypeParse:
+		var name, query string
+		name, query, _, err = GetParseMessage(msg)
+		description = fmt.Sprintf("Parse %q %q", name, query)
+	case MessageTypeBind:
+		var portal, statement string
+		portal, statement, _, err = GetBindMessage(msg)
+		description = fmt.Sprintf("Bind %q %q", portal, statement)
+	case MessageTypeQuery:
+		description = fmt.Sprintf("Query %q", GetQuery(msg))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return description
+}
+
+func testQuery(t *testing.T, query string) []byte {
+	msg, err := CreateQueryMessage(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func testTarget(t *testing.T, messageType byte, name string) []byte {
+	msg, err := CreateTargetMessage(messageType, TargetPreparedStatement, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func testBackendMessages(t *testing.T, messageTypes string) (messages [][]byte) {
+	for _, messageType := range []byte(messageTypes) {
+		var msg []byte
+		var err error
+		switch messageType {
+		case MessageTypeReadyForQuery:
+			msg, err = ReadyForQueryMessage()
+		case MessageTypeErrorResponse:
+			msg, err = ErrorResponseMessage(ErrorSeverityError, SQLStateSyntaxError, "syntax error")
+		case MessageTypeCommandComplete:
+			msg, err = CommandCompleteMessage("SELECT 1")
+		default:
+			msg, err = CompleteMessage(messageType)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// trackerStep sends frontend messages through the tracker, then answers them with backend messages of the given types.
+type trackerStep struct {
+	frontend func(t *testing.T) [][]byte
+	backend  string
+}
+
+func TestStatementTracker(t *testing.T) {
+	tests := []struct {
+		name string
+		// Statements the client prepared on an earlier backend, by name
+		statements map[string]string
+		steps      []trackerStep
+		// Messages sent to the backend
+		sent []string
+		// Types of the messages sent to the frontend
+		received string
+	}{
+		{
+			name: "named Parse is prepared under a proxy name",
+			steps: []trackerStep{{
+				frontend: func(t *testing.T) [][]byte {
+					return [][]byte{testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync)}
+				},
+				backend: "1Z",
+			}},
+			sent:     []string{`Parse "pgproxy_1" "SELECT 1"`, "S"},
+			received: "1Z",
+		},
+		{
+			name:       "statement of an earlier backend is parsed again",
+			statements: map[string]string{"s1": "SELECT 1"},
+			steps: []trackerStep{{
+				frontend: func(t *testing.T) [][]byte {
+					return [][]byte{testBind(t, "s1"), testMessage(t, MessageTypeExecute), testMessage(t, MessageTypeSync)}
+				},
+				backend: "12CZ",
+			}},
+			sent:     []string{`Parse "pgproxy_1" "SELECT 1"`, `Bind "" "pgproxy_1"`, "E", "S"},
+			received: "2CZ",
+		},
+		{
+			name: "statement already prepared on the backend is answered by the proxy",
+			steps: []trackerStep{
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "1Z",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s2", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "Z",
+				},
+			},
+			sent:     []string{`Parse "pgproxy_1" "SELECT 1"`, "S", "S"},
+			received: "1Z1Z",
+		},
+		{
+			name: "proxy response waits for earlier responses",
+			steps: []trackerStep{
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "1Z",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testBind(t, ""), testParse(t, "s2", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "2Z",
+				},
+			},
+			sent:     []string{`Parse "pgproxy_1" "SELECT 1"`, "S", `Bind "" ""`, "S"},
+			received: "1Z21Z",
+		},
+		{
+			name: "error skips to Sync and forgets the failed Parse",
+			steps: []trackerStep{
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{
+							testParse(t, "s1", "SELEC 1"), testBind(t, "s1"), testMessage(t, MessageTypeExecute),
+							testMessage(t, MessageTypeSync),
+						}
+					},
+					backend: "EZ",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s1", "SELEC 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "EZ",
+				},
+			},
+			sent: []string{
+				`Parse "pgproxy_1" "SELEC 1"`, `Bind "" "pgproxy_1"`, "E", "S",
+				`Parse "pgproxy_2" "SELEC 1"`, "S",
+			},
+			received: "EZEZ",
+		},
+		{
+			name: "Parse of an existing name fails and skips to Sync",
+			steps: []trackerStep{
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "1Z",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{
+							testParse(t, "s1", "SELECT 2"), testBind(t, "s1"), testMessage(t, MessageTypeExecute),
+							testMessage(t, MessageTypeSync),
+						}
+					},
+					backend: "Z",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testBind(t, "s1"), testMessage(t, MessageTypeExecute), testMessage(t, MessageTypeSync)}
+					},
+					backend: "2CZ",
+				},
+			},
+			sent: []string{
+				`Parse "pgproxy_1" "SELECT 1"`, "S",
+				"S",
+				`Bind "" "pgproxy_1"`, "E", "S",
+			},
+			received: "1ZEZ2CZ",
+		},
+		{
+			name: "DEALLOCATE is rewritten to the proxy name",
+			steps: []trackerStep{
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "1Z",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testQuery(t, "DEALLOCATE S1")}
+					},
+					backend: "CZ",
+				},
+			},
+			sent:     []string{`Parse "pgproxy_1" "SELECT 1"`, "S", `Query "DEALLOCATE pgproxy_1"`},
+			received: "1ZCZ",
+		},
+		{
+			name: "DEALLOCATE PREPARE in an unnamed Parse is rewritten to the proxy name",
+			steps: []trackerStep{
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "1Z",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "", "deallocate prepare s1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "1Z",
+				},
+			},
+			sent:     []string{`Parse "pgproxy_1" "SELECT 1"`, "S", `Parse "" "DEALLOCATE pgproxy_1"`, "S"},
+			received: "1Z1Z",
+		},
+		{
+			name:       "DEALLOCATE of a statement not prepared on the backend is answered by the proxy",
+			statements: map[string]string{"s1": "SELECT 1"},
+			steps: []trackerStep{{
+				frontend: func(t *testing.T) [][]byte {
+					return [][]byte{testQuery(t, "DEALLOCATE s1")}
+				},
+				backend: "IZ",
+			}},
+			sent:     []string{`Query ""`},
+			received: "CZ",
+		},
+		{
+			name:       "DEALLOCATE of a quoted name is left to the backend",
+			statements: map[string]string{"s1": "SELECT 1"},
+			steps: []trackerStep{{
+				frontend: func(t *testing.T) [][]byte {
+					return [][]byte{testQuery(t, `DEALLOCATE "s1"`)}
+				},
+				backend: "CZ",
+			}},
+			sent:     []string{`Query "DEALLOCATE \"s1\""`},
+			received: "CZ",
+		},
+		{
+			name: "DISCARD ALL forgets the statements",
+			steps: []trackerStep{
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "1Z",
+				},
+				{
+					frontend: func(t *testing.T) [][]byte {
+						return [][]byte{testQuery(t, "DISCARD ALL"), testBind(t, "s1"), testMessage(t, MessageTypeSync)}
+					},
+					backend: "CZEZ",
+				},
+			},
+			sent:     []string{`Parse "pgproxy_1" "SELECT 1"`, "S", `Query "DISCARD ALL"`, `Bind "" "s1"`, "S"},
+			received: "1ZCZEZ",
+		},
+		{
+			name:       "Close of a statement not prepared on the backend is answered by the proxy",
+			statements: map[string]string{"s1": "SELECT 1"},
+			steps: []trackerStep{{
+				frontend: func(t *testing.T) [][]byte {
+					return [][]byte{testTarget(t, MessageTypeClose, "s1"), testMessage(t, MessageTypeSync)}
+				},
+				backend: "Z",
+			}},
+			sent:     []string{"S"},
+			received: "3Z",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			preparedStatementCounter = 0
+			tracker := NewStatementTracker()
+			for name, query := range test.statements {
+				tracker.statements[name] = &PreparedStatement{Query: query}
+			}
+			backend, frontend := &recordingConn{}, &recordingConn{}
+			pg, client := &PGConnection{Conn: backend}, &PGConnection{Conn: frontend}
+			for _, step := range test.steps {
+				for _, msg := range step.frontend(t) {
+					messages, err := tracker.Frontend(pg, client, msg)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, message := range messages {
+						pg.SendMessage(message)
+					}
+				}
+				for _, msg := range testBackendMessages(t, step.backend) {
+					if err := tracker.Backend(pg, client, msg); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if sent := describeMessages(t, backend.written.Bytes()); !reflect.DeepEqual(sent, test.sent) {
+				t.Errorf("sent %q, want %q", sent, test.sent)
+			}
+			received := ""
+			for _, description := range describeMessages(t, frontend.written.Bytes()) {
+				received += description[:1]
+			}
+			if received != test.received {
+				t.Errorf("received %q, want %q", received, test.received)
+			}
+			if len(tracker.pending) != 0 {
+				t.Errorf("%d responses still pending", len(tracker.pending))
+			}
+		})
+	}
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
-	"crypto/x509"
-	"io"
+	"errors"
+	"fmt"
 	"log"
-	"math"
-	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 /**
@@ -59,236 +61,465 @@ const (
 type PostgresProxy struct {
 	ForwardConnection *PGConnection //Backend
 	ReverseConnection *PGConnection //Frontend
-	forwardChannel    chan struct{}
-	reverseChannel    chan struct{}
-	pmutex            sync.Mutex
-	channelRecorder   ChannelRecorder
+	// The accepted client socket, underneath ReverseConnection
+	socket   net.Conn
+	Config   *Config
+	Router   *Router
+	Route    *Route
+	Pools    *PoolManager
+	Replicas *ReplicaSelector
+	Cancels  *CancelRegistry
+	Metrics  *Metrics
+	Tracer   *Tracer
+	Admin    *AdminConsole
+	// Entry of the session in the registry, see SessionRegistry
+	connection *Connection
+	// Session span, the parent of the spans of the session's handshake and queries
+	span *Span
+	// Timing of the TLS handshake, traced once the session span starts
+	tlsHandshake *spanTiming
+	queries      *QueryCycles
+	// Key the frontend cancels its queries with, registered in Cancels
+	cancelKey *CancelKey
+	// Server side TLS configuration, nil when SSL is disabled
+	TLSConfig *tls.Config
+	CertAuth  *CertAuthenticator
+	// Set when the frontend was authenticated by its client certificate
+	identity *IdentityMappingConfig
+	pool     *Pool
+	// Set for clients with read/write splitting
+	split      *SplitState
+	state      *TransactionState
+	statements *StatementTracker
+	// Backend ParameterStatus values reported to the frontend at startup
+	parameters  map[string]string
+	session     *SessionParameters
+	backendDone chan Packet
+	pmutex      sync.Mutex
+	closed      bool
+	// Set on shutdown, the session ends once idle
+	draining        bool
+	channelRecorder *ChannelRecorder
 }
 
 func (proxy *PostgresProxy) UpgradeReverseConnection() error {
-	ca, err := x509.SystemCertPool()
+	if proxy.TLSConfig == nil {
+		return errors.New("SSL is disabled")
+	}
+	conn := tls.Server(proxy.ReverseConnection.Conn, proxy.TLSConfig)
+	start := time.Now()
+	err := conn.Handshake()
+	proxy.tlsHandshake = &spanTiming{start: start, end: time.Now(), err: err}
 	if err != nil {
-		return err
+		return &handshakeError{reason: HandshakeFailureTLS, err: err}
 	}
-	proxy.ReverseConnection.Conn =
-		tls.Server(proxy.ReverseConnection.Conn, &tls.Config{
-			RootCAs:            ca,
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS10,
-			MaxVersion:         tls.VersionTLS13,
-			GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				crt, err := tls.LoadX509KeyPair(proxy.ReverseConnection.certFile, proxy.ReverseConnection.keyFile)
-				if err != nil {
-					return nil, err
-				}
-				return &crt, err
-			},
-		})
+	proxy.ReverseConnection.Conn = conn
 	return nil
 }
 
-func (proxy *PostgresProxy) UpgradeForwardConnection() error {
-	crt, err := tls.LoadX509KeyPair(proxy.ForwardConnection.certFile, proxy.ForwardConnection.keyFile)
+/**
+ * forwardConnectionHandshake hands the session an authenticated backend connection from the pool.
+ *
+ * In transaction mode no connection is attached up front once the pool knows the backend's parameters.
+ */
+func (proxy *PostgresProxy) forwardConnectionHandshake() error {
+	pool, err := proxy.Pools.Join(proxy.Route)
 	if err != nil {
+		proxy.sendPoolError(err)
 		return err
 	}
-	ca, err := x509.SystemCertPool()
+	proxy.pmutex.Lock()
+	if proxy.closed {
+		proxy.pmutex.Unlock()
+		pool.Leave()
+		return errors.New("session closed during backend handshake")
+	}
+	proxy.pool = pool
+	proxy.pmutex.Unlock()
+	if parameters := proxy.pool.Parameters(); parameters != nil && proxy.pool.Mode() == PoolModeTransaction {
+		proxy.parameters = parameters
+		return nil
+	}
+	span := proxy.span.Child("backend acquire", SpanKindInternal, time.Now())
+	span.SetAttribute("pgproxy.pool", proxy.pool.Key.String())
+	request := proxy.poolRequest()
+	request.Span = span
+	if resumed := proxy.Pools.Resumed(); resumed != nil {
+		// Paused on the admin console
+		<-resumed
+	}
+	pg, err := proxy.pool.Acquire(request)
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.End()
 	if err != nil {
+		proxy.sendPoolError(err)
 		return err
 	}
-	proxy.ForwardConnection.Conn =
-		tls.Client(proxy.ForwardConnection.Conn, &tls.Config{
-			RootCAs:            ca,
-			Certificates:       []tls.Certificate{crt},
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS10,
-			MaxVersion:         tls.VersionTLS13,
-		})
+	proxy.pmutex.Lock()
+	defer proxy.pmutex.Unlock()
+	if proxy.closed {
+		pg.pool.Release(pg, true)
+		return errors.New("session closed during backend handshake")
+	}
+	proxy.session.Apply(pg)
+	proxy.ForwardConnection = pg
+	proxy.parameters = pg.parameters
 	return nil
 }
 
-func (proxy *PostgresProxy) forwardConnectionHandshake() {
-	go func() {
-		for {
-			select {
-			case packet := <-proxy.ForwardConnection.C:
-				if packet.Error != nil {
-					_ = proxy.Close()
-					return
-				}
-			case <-proxy.forwardChannel:
-				return
+func (proxy *PostgresProxy) poolRequest() PoolRequest {
+	return PoolRequest{User: proxy.ReverseConnection.username, ApplicationName: proxy.ReverseConnection.application}
+}
+
+func (proxy *PostgresProxy) sendPoolError(err error) {
+	if errors.Is(err, ErrPoolExhausted) || errors.Is(err, ErrTooManyPools) {
+		_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateTooManyConnections, err.Error())
+		return
+	}
+	_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateConnectionFailure,
+		fmt.Sprintf("could not connect to backend %q", proxy.Route.BackendName))
+}
+
+func (proxy *PostgresProxy) reverseConnectionStartup() error {
+	if err := proxy.negotiateDirectSSL(); err != nil {
+		return err
+	}
+	// Answer encryption requests until the frontend sends its startup message
+	negotiated := make(map[int32]bool)
+	for {
+		packet := proxy.ReverseConnection.ReadStartupMessage()
+		if packet.Error != nil {
+			return fmt.Errorf("startup packet from %v: %w", proxy.ReverseConnection.Conn.RemoteAddr(), packet.Error)
+		}
+		msg := packet.Body
+		version, err := GetVersion(msg)
+		if err != nil {
+			return err
+		}
+		if version == SSLRequestCode || version == GSSENCRequestCode {
+			if _, ok := proxy.ReverseConnection.Conn.(*tls.Conn); ok || negotiated[version] {
+				return fmt.Errorf("unexpected encryption request from %v after negotiation", proxy.ReverseConnection.Conn.RemoteAddr())
 			}
+			negotiated[version] = true
+		}
+		switch version {
+		case SSLRequestCode:
+			if err := proxy.negotiateSSL(); err != nil {
+				return err
+			}
+		case GSSENCRequestCode:
+			// GSSAPI encryption is not supported, the frontend may go on with SSL or in plaintext
+			if err := proxy.ReverseConnection.sendSSLResponse(SSLNotAllowed); err != nil {
+				return err
+			}
+		case CancelRequestCode:
+			return proxy.cancelRequest(msg)
+		default:
+			return proxy.startup(msg, version)
 		}
-	}()
-	// Send SSL request to backend
-	proxy.ForwardConnection.sendSSLRequest()
-	// Read backend response
-	packet := proxy.ForwardConnection.ReceiveMessage()
-	if packet.Error != nil {
-		_ = proxy.Close()
 	}
-	// Terminate Connection if backend doesn't support SSL
-	if packet.Body != nil && len(packet.Body) > 0 && packet.Body[0] == SSLNotAllowed {
-		_ = proxy.Close()
+}
+
+// negotiateSSL answers an SSLRequest and upgrades the connection when SSL is enabled.
+func (proxy *PostgresProxy) negotiateSSL() error {
+	if proxy.TLSConfig == nil {
+		// SSL is disabled, the frontend may go on in plaintext
+		return proxy.ReverseConnection.sendSSLResponse(SSLNotAllowed)
 	}
-	// Upgrade tls client connection
-	if err := proxy.UpgradeForwardConnection(); err != nil {
-		_ = proxy.Close()
+	// Send SSL allowed response to frontend
+	if err := proxy.ReverseConnection.sendSSLResponse(SSLAllowed); err != nil {
+		return err
 	}
-	// Send startup request to backend
-	proxy.ForwardConnection.sendStartupMessage()
-	// Read response for startup message from backend
-	packet = proxy.ForwardConnection.ReceiveMessage()
-	if packet.Error != nil {
-		_ = proxy.Close()
+	// Upgrade tls server connection
+	return proxy.UpgradeReverseConnection()
+}
+
+/**
+ * startup records the startup message of the frontend.
+ *
+ * The proxy speaks protocol 3.0 and 3.2 with frontends, whatever its backends speak. Frontends asking for
+ * a newer minor version, or for protocol options (_pq_.*), get a NegotiateProtocolVersion with the version
+ * and options the proxy supports, and go on with those.
+ */
+func (proxy *PostgresProxy) startup(msg []byte, version int32) error {
+	if _, ok := proxy.ReverseConnection.Conn.(*tls.Conn); !ok && proxy.Config.TLS.Mode == FrontendSSLRequire {
+		_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateInvalidAuthorization,
+			"SSL connection is required")
+		return &handshakeError{reason: HandshakeFailureSSLRequired,
+			err: fmt.Errorf("rejected plaintext connection from %v", proxy.ReverseConnection.Conn.RemoteAddr())}
+	}
+	if major := ProtocolMajorVersion(version); major != ProtocolMajorVersion(ProtocolVersionLatest) {
+		_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateFeatureNotSupported,
+			fmt.Sprintf("unsupported frontend protocol %d.%d: server supports 3.0 to 3.%d", major,
+				ProtocolMinorVersion(version), ProtocolMinorVersion(ProtocolVersionLatest)))
+		return &handshakeError{reason: HandshakeFailureProtocol,
+			err: fmt.Errorf("unsupported protocol version %d from %v", version, proxy.ReverseConnection.Conn.RemoteAddr())}
+	}
+	// Record the startup attributes of the frontend
+	attributes := GetStartupMessageAttributes(msg)
+	var options []string
+	for name := range attributes {
+		if strings.HasPrefix(name, ProtocolOptionPrefix) {
+			options = append(options, name)
+			delete(attributes, name)
+		}
+	}
+	// Minor version 1 was never used, 3.1 frontends get 3.0
+	proxy.ReverseConnection.protocolVersion = ProtocolVersion
+	if version >= ProtocolVersion32 {
+		proxy.ReverseConnection.protocolVersion = ProtocolVersion32
 	}
+	if version > ProtocolVersionLatest || len(options) > 0 {
+		sort.Strings(options)
+		minor := ProtocolMinorVersion(version)
+		if version > ProtocolVersionLatest {
+			minor = ProtocolMinorVersion(ProtocolVersionLatest)
+		}
+		if err := proxy.ReverseConnection.sendNegotiateProtocolVersion(minor, options); err != nil {
+			return err
+		}
+	}
+	proxy.ReverseConnection.username = attributes[ConnectionAttributeUser]
+	proxy.ReverseConnection.database = attributes[ConnectionAttributeDatabase]
+	proxy.ReverseConnection.application = attributes[ConnectionAttributeApplicationName]
+	proxy.ReverseConnection.attributes = attributes
+	proxy.session = NewSessionParameters(proxy.Config.TrackParameters, attributes)
+	return nil
+}
+
+// ServerName returns the SNI hostname sent by the frontend, if the connection was upgraded to TLS.
+func (proxy *PostgresProxy) ServerName() string {
+	if conn, ok := proxy.ReverseConnection.Conn.(*tls.Conn); ok {
+		return conn.ConnectionState().ServerName
+	}
+	return ""
+}
 
-	authType, err := GetAuthenticationType(packet.Body)
+// route resolves the backend for the frontend.
+func (proxy *PostgresProxy) route() error {
+	route, err := proxy.Router.Resolve(NewRouteRequest(proxy.ReverseConnection.attributes, proxy.ServerName()))
+	if errors.Is(err, ErrNoRoute) {
+		_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateInvalidCatalogName, err.Error())
+		return err
+	}
 	if err != nil {
-		_ = proxy.Close()
+		_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateConnectionFailure, err.Error())
+		return err
 	}
-	switch authType {
-	case AuthenticationClearTextPassword:
-		// Send the clearText password response
-		proxy.ForwardConnection.sendPasswordResponse()
-	default:
-		log.Println("auth type not supported")
-		_ = proxy.Close()
-		return
+	if proxy.identity != nil && proxy.identity.BackendUser != "" {
+		route.Username, route.Password = proxy.identity.BackendUser, proxy.identity.BackendPassword
+		route.MappedCredentials = true
 	}
+	proxy.Route = route
+	proxy.span.SetAttribute("pgproxy.backend", route.BackendName)
+	log.Printf("routing %v to backend %v", proxy.ReverseConnection.Conn.RemoteAddr(), route.BackendName)
+	return nil
+}
 
-	// Read backend's authentication response
-	packet = proxy.ForwardConnection.ReceiveMessage()
-	if packet.Error != nil {
-		_ = proxy.Close()
+/**
+ * authenticate asks frontends not authenticated by their certificate for the password, and checks it against
+ * the configured users. Users without a password in users can only log in by certificate.
+ */
+func (proxy *PostgresProxy) authenticate() error {
+	span := proxy.span.Child("authenticate", SpanKindInternal, time.Now())
+	defer span.End()
+	if proxy.identity != nil {
+		span.SetAttribute("pgproxy.auth.method", "certificate")
+		return nil
 	}
-	// Check backend authentication status
-	if !proxy.ForwardConnection.isAuthenticationOK(packet.Body) {
-		_ = proxy.Close()
+	span.SetAttribute("pgproxy.auth.method", "password")
+	given, err := proxy.passwordHandshake()
+	if err != nil {
+		span.SetError(err.Error())
+		return err
+	}
+	frontend := proxy.ReverseConnection
+	password := proxy.Config.Users[frontend.username]
+	if password == "" || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+		err := fmt.Errorf("password authentication failed for user %q", frontend.username)
+		_ = frontend.sendErrorResponse(ErrorSeverityFatal, SQLStateInvalidPassword, err.Error())
+		span.SetError(err.Error())
+		return err
 	}
+	return nil
 }
 
-func (proxy *PostgresProxy) reverseConnectionHandshake() {
-	go func() {
-		for {
-			select {
-			case packet := <-proxy.ReverseConnection.C:
-				if packet.Error != nil {
-					_ = proxy.Close()
-					return
-				}
-			case <-proxy.reverseChannel:
-				return
-			}
+// reverseConnectionHandshake completes the startup of the authenticated frontend once its backend is known.
+func (proxy *PostgresProxy) reverseConnectionHandshake() error {
+	// Send AuthenticationOk
+	if err := proxy.ReverseConnection.sendAuthenticationOKResponse(); err != nil {
+		return err
+	}
+	// Send Parameter Status as reported by the backend, with the frontend's own settings.
+	// These are the values the frontend expects on every backend it is attached to later on.
+	parameters := proxy.session.Report(proxy.parameters)
+	for name, value := range parameters {
+		proxy.session.Update(name, value)
+	}
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := proxy.ReverseConnection.sendParameterStatus(name, parameters[name]); err != nil {
+			return err
 		}
-	}()
-	// Read frontend startup message
-	packet := proxy.ReverseConnection.ReceiveMessage()
-	if packet.Error != nil {
-		_ = proxy.Close()
 	}
-	// Check SSL request or startup message
-	version, err := GetVersion(packet.Body)
+	if err := proxy.sendCancelKey(); err != nil {
+		return err
+	}
+	// Send ReadyForQuery
+	return proxy.ReverseConnection.sendReadyForQuery()
+}
+
+// sendCancelKey sends the session's own cancel key, see CancelRegistry.
+func (proxy *PostgresProxy) sendCancelKey() error {
+	length := 4
+	if proxy.ReverseConnection.protocolVersion >= ProtocolVersion32 {
+		length = CancelKeyLength32
+	}
+	key, err := proxy.Cancels.Register(proxy, length)
 	if err != nil {
-		_ = proxy.Close()
+		return err
 	}
-	if SSLRequestCode == version {
-		// Send SSL allowed response to backend
-		proxy.ReverseConnection.sendSSLResponse(SSLAllowed)
-		// Upgrade tls server connection
-		if err := proxy.UpgradeReverseConnection(); err != nil {
-			_ = proxy.Close()
-		}
-		// Read startup message from frontend (one more time)
-		packet = proxy.ReverseConnection.ReceiveMessage()
-		if packet.Error != nil {
-			_ = proxy.Close()
-		}
+	proxy.pmutex.Lock()
+	proxy.cancelKey = &key
+	proxy.pmutex.Unlock()
+	return proxy.ReverseConnection.sendBackendKeyData(key.ProcessID, []byte(key.SecretKey))
+}
+
+// passwordHandshake asks the frontend for its password, frontends authenticated by certificate skip it.
+func (proxy *PostgresProxy) passwordHandshake() (string, error) {
+	// Send clear text password request to frontend
+	if err := proxy.ReverseConnection.sendAuthenticationClearTextPasswordRequest(); err != nil {
+		return "", err
 	}
-	// Send clear text password request to backend
-	proxy.ReverseConnection.sendAuthenticationClearTextPasswordRequest()
 	// Read frontend password
-	packet = proxy.ReverseConnection.ReceiveMessage()
+	packet := proxy.ReverseConnection.ReadMessageLimit(MaxAuthMessageLength)
 	if packet.Error != nil {
-		_ = proxy.Close()
+		return "", packet.Error
 	}
-	// Send AuthenticationOk
-	proxy.ReverseConnection.sendAuthenticationOKResponse()
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("application_name", "psql")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("client_encoding", "UTF8")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("DateStyle", "ISO, MDY")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("integer_datetimes", "on")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("IntervalStyle", "postgres")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("is_superuser", "on")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("server_version", "12.14 (Debian 12.14-1.pgdg110+1)")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("session_authorization", "postgres")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("standard_conforming_strings", "on")
-	// Send Parameter Status
-	proxy.ReverseConnection.sendParameterStatus("TimeZone", "Etc/UTC")
-	// Send Backend KeyData
-	proxy.ReverseConnection.sendBackendKeyData(rand.Int31n(math.MaxInt32), rand.Int31n(math.MaxInt32))
-	// Send ReadyForQuery
-	proxy.ReverseConnection.sendReadyForQuery()
+	if GetMessageType(packet.Body) != MessageTypePasswordResponse {
+		return "", fmt.Errorf("expected password response, got %q", GetMessageType(packet.Body))
+	}
+	return GetPasswordFromPasswordMessage(packet.Body)
 }
 
 func (proxy *PostgresProxy) Connect() {
-	proxy.forwardConnectionHandshake()
-	proxy.reverseConnectionHandshake()
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer func() {
-			wg.Done()
-		}()
-		proxy.transfer(proxy.ForwardConnection.Conn, proxy.ReverseConnection.Conn)
+	defer func() {
+		_ = proxy.Close()
 	}()
+	accepted := proxy.connection.Started
+	proxy.Metrics.ClientConnectionsAccepted.With().Inc()
+	err := proxy.reverseConnectionStartup()
+	if errors.Is(err, errCancelRequestHandled) {
+		return
+	}
+	proxy.startSpan(accepted)
+	if err != nil {
+		proxy.handshakeFailed(HandshakeFailureProtocol, err)
+		return
+	}
+	if err := proxy.authenticateCertificate(); err != nil {
+		proxy.handshakeFailed(HandshakeFailureCertificate, err)
+		return
+	}
+	if proxy.Admin.handles(proxy.ReverseConnection.attributes) {
+		proxy.console()
+		return
+	}
+	// Frontends authenticate before they may create a pool or hold a backend connection
+	if err := proxy.authenticate(); err != nil {
+		proxy.handshakeFailed(HandshakeFailureAuthentication, err)
+		return
+	}
+	if err := proxy.route(); err != nil {
+		reason := HandshakeFailureBackend
+		if errors.Is(err, ErrNoRoute) {
+			reason = HandshakeFailureNoRoute
+		}
+		proxy.handshakeFailed(reason, err)
+		return
+	}
+	if err := proxy.forwardConnectionHandshake(); err != nil {
+		reason := HandshakeFailureBackend
+		if errors.Is(err, ErrPoolExhausted) || errors.Is(err, ErrTooManyPools) {
+			reason = HandshakeFailurePoolExhausted
+		}
+		proxy.handshakeFailed(reason, err)
+		return
+	}
+	if err := proxy.reverseConnectionHandshake(); err != nil {
+		proxy.handshakeFailed(HandshakeFailureProtocol, err)
+		return
+	}
+	proxy.login()
 
-	wg.Add(1)
-	go func() {
-		defer func() {
-			wg.Done()
-		}()
-		proxy.transfer(proxy.ReverseConnection.Conn, proxy.ForwardConnection.Conn)
-	}()
-	wg.Wait()
+	metrics := proxy.pool.metrics
+	metrics.ClientsTotal.Inc()
+	metrics.ClientConnections.Inc()
+	defer metrics.ClientConnections.Dec()
+	proxy.transfer()
 }
 
-func (proxy *PostgresProxy) transfer(src, dst net.Conn) {
-	defer func() {
-		_ = src.Close()
-		_ = dst.Close()
-	}()
+// handshakeFailed logs and counts a failed handshake, and records it on the session span.
+func (proxy *PostgresProxy) handshakeFailed(reason string, err error) {
+	log.Println(err)
+	proxy.Metrics.HandshakeFailed(reason, err)
+	proxy.span.SetError(err.Error())
+}
 
-	go proxy.channelRecorder.Watch()
-	dest := io.MultiWriter(dst, proxy.channelRecorder)
-	n, err := io.Copy(dest, src)
-	if err != nil {
-		log.Println(err)
+// startSpan starts the session span once the startup message has told who the client is.
+func (proxy *PostgresProxy) startSpan(accepted time.Time) {
+	frontend := proxy.ReverseConnection
+	span := proxy.Tracer.Start("pgproxy session", SpanKindServer, FindTraceparent(frontend.application), accepted)
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("pgproxy.session.id", proxy.connection.ID)
+	span.SetAttribute("client.address", frontend.Conn.RemoteAddr().String())
+	if frontend.username != "" {
+		span.SetAttribute("db.user", frontend.username)
+		span.SetAttribute("db.name", frontend.database)
 	}
-	log.Printf("postgres-proxy: transferred %d bytes", n)
+	if frontend.application != "" {
+		span.SetAttribute("pgproxy.application_name", frontend.application)
+	}
+	if handshake := proxy.tlsHandshake; handshake != nil {
+		child := span.Child("tls handshake", SpanKindInternal, handshake.start)
+		if serverName := proxy.ServerName(); serverName != "" {
+			child.SetAttribute("tls.server.name", serverName)
+		}
+		if handshake.err != nil {
+			child.SetError(handshake.err.Error())
+		}
+		child.EndAt(handshake.end)
+	}
+	proxy.pmutex.Lock()
+	proxy.span = span
+	proxy.pmutex.Unlock()
 }
 
 func (proxy *PostgresProxy) Close() error {
-	proxy.forwardChannel <- struct{}{}
-	proxy.reverseChannel <- struct{}{}
+	proxy.pmutex.Lock()
+	defer proxy.pmutex.Unlock()
+	if proxy.closed {
+		return nil
+	}
+	proxy.closed = true
+	proxy.span.End()
 	proxy.channelRecorder.Close()
+	if proxy.cancelKey != nil {
+		proxy.Cancels.Unregister(*proxy.cancelKey)
+	}
 
-	if err := proxy.ForwardConnection.Close(); err != nil {
-		return err
+	if proxy.ForwardConnection != nil {
+		proxy.ForwardConnection.pool.Release(proxy.ForwardConnection, false)
+		proxy.ForwardConnection = nil
 	}
-	if err := proxy.ReverseConnection.Close(); err != nil {
-		return err
+	if proxy.pool != nil {
+		proxy.pool.Leave()
 	}
-	return nil
+	return proxy.ReverseConnection.Close()
 }
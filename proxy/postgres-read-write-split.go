@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Read/write splitting
+ *
+ * Clients that opt in, through a route's read_write_split or the pgproxy.read_write_split startup option,
+ * have each query cycle routed on its own: a cycle that starts outside of a transaction with a read-only
+ * statement (see IsReadOnlyQuery) runs on a standby of the cluster, everything else on the primary.
+ * After a write, the client's reads stay on the primary for the cluster's sticky_after_write window.
+ *
+ * Splitting needs backends to be detached between query cycles, so it only applies in transaction mode.
+ */
+
+const (
+	ReplicaSelectionRoundRobin       = "round_robin"
+	ReplicaSelectionLeastConnections = "least_connections"
+	ReplicaSelectionWeighted         = "weighted"
+)
+
+var ErrNoReplica = errors.New("no standby available")
+
+type ReplicaSelector struct {
+	config *Config
+	health *HealthChecker
+	pools  *PoolManager
+	mutex  sync.Mutex
+	// Round-robin position, by cluster
+	next map[string]int
+	// Smooth weighted round-robin state, by cluster and backend
+	current map[string]map[string]int
+}
+
+func NewReplicaSelector(config *Config, health *HealthChecker, pools *PoolManager) *ReplicaSelector {
+	return &ReplicaSelector{
+		config:  config,
+		health:  health,
+		pools:   pools,
+		next:    make(map[string]int),
+		current: make(map[string]map[string]int),
+	}
+}
+
+// Select picks the standby of a cluster that serves the next read, among those within maxLag of the primary.
+func (selector *ReplicaSelector) Select(cluster string, maxLag time.Duration) (string, error) {
+	standbys := selector.health.Standbys(cluster, maxLag)
+	if len(standbys) == 0 {
+		return "", fmt.Errorf("%w in cluster %q", ErrNoReplica, cluster)
+	}
+	config := selector.config.Clusters[cluster]
+	switch config.ReplicaSelection {
+	case ReplicaSelectionLeastConnections:
+		return selector.leastConnections(standbys), nil
+	case ReplicaSelectionWeighted:
+		return selector.weighted(cluster, config, standbys)
+	default:
+		selector.mutex.Lock()
+		defer selector.mutex.Unlock()
+		n := selector.next[cluster]
+		selector.next[cluster] = n + 1
+		return standbys[n%len(standbys)], nil
+	}
+}
+
+func (selector *ReplicaSelector) leastConnections(standbys []string) string {
+	best, least := "", 0
+	for _, name := range standbys {
+		if busy := selector.pools.InUse(name); best == "" || busy < least {
+			best, least = name, busy
+		}
+	}
+	return best
+}
+
+// weighted is the smooth weighted round-robin of nginx: it spreads each standby's turns evenly.
+func (selector *ReplicaSelector) weighted(cluster string, config *ClusterConfig, standbys []string) (string, error) {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+	current, ok := selector.current[cluster]
+	if !ok {
+		current = make(map[string]int)
+		selector.current[cluster] = current
+	}
+	best, total := "", 0
+	for _, name := range standbys {
+		weight, ok := config.Weights[name]
+		if !ok {
+			weight = 1
+		}
+		if weight == 0 {
+			continue
+		}
+		current[name] += weight
+		total += weight
+		if best == "" || current[name] > current[best] {
+			best = name
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("%w in cluster %q: every standby has weight 0", ErrNoReplica, cluster)
+	}
+	current[best] -= total
+	return best, nil
+}
+
+// SplitState follows the writes of a read/write split client.
+type SplitState struct {
+	mutex     sync.Mutex
+	sticky    time.Duration
+	lastWrite time.Time
+	// The attached backend runs a write
+	writing bool
+}
+
+// Attach records the query cycle a client starts and reports whether it may run on a standby.
+func (state *SplitState) Attach(readOnly bool) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.writing = !readOnly
+	return readOnly && time.Since(state.lastWrite) >= state.sticky
+}
+
+// Detach starts the sticky window when the cycle that ended wrote.
+func (state *SplitState) Detach() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.writing {
+		state.lastWrite = time.Now()
+		state.writing = false
+	}
+}
+
+// startSplit enables read/write splitting for clients that opted in.
+func (proxy *PostgresProxy) startSplit() {
+	option := proxy.ReverseConnection.attributes[ConnectionAttributeReadWriteSplit]
+	if !proxy.Route.ReadWriteSplit && !isTrue(option) {
+		return
+	}
+	if proxy.Route.Cluster == "" || proxy.pool.Mode() != PoolModeTransaction {
+		log.Printf("read/write splitting of %v needs a cluster in transaction mode", proxy.ReverseConnection.Conn.RemoteAddr())
+		return
+	}
+	proxy.split = &SplitState{sticky: proxy.Config.Clusters[proxy.Route.Cluster].StickyAfterWrite.Duration}
+}
+
+// isTrue accepts the boolean spellings of PostgreSQL settings.
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1":
+		return true
+	}
+	return false
+}
+
+/**
+ * splitBatch holds back the extended query messages of a query cycle until it is known whether the cycle only
+ * reads: up to Sync, Flush or another message that ends the batch, or up to a statement that isn't read-only.
+ *
+ * Pipelined batches, e.g. of pgx or JDBC, run several statements before their Sync, so a statement that writes
+ * anywhere in the batch takes the whole cycle to the primary. So does a batch larger than MaxSplitBatchSize,
+ * whose remaining messages are not held back.
+ */
+type splitBatch struct {
+	messages [][]byte
+	size     int
+	// Statements parsed in the batch, "" for the unnamed statement
+	parsed map[string]bool
+	read   bool
+	write  bool
+}
+
+// Read-only extended query messages are held back up to this many bytes
+const MaxSplitBatchSize = 1 << 20
+
+// Add holds back a frontend message and reports whether the batch goes on.
+func (batch *splitBatch) Add(proxy *PostgresProxy, msg []byte) bool {
+	batch.messages = append(batch.messages, msg)
+	batch.size += len(msg)
+	switch GetMessageType(msg) {
+	case MessageTypeParse:
+		name, _, _, err := GetParseMessage(msg)
+		if err != nil || !proxy.readOnly(msg) {
+			batch.write = true
+		} else {
+			batch.read, batch.parsed[name] = true, true
+		}
+	case MessageTypeBind:
+		_, name, _, err := GetBindMessage(msg)
+		switch {
+		case err != nil:
+			batch.write = true
+		case batch.parsed[name]:
+		case proxy.readOnly(msg):
+			batch.read = true
+		default:
+			batch.write = true
+		}
+	case MessageTypeQuery:
+		if proxy.readOnly(msg) {
+			batch.read = true
+		} else {
+			batch.write = true
+		}
+	case MessageTypeDescribe, MessageTypeExecute, MessageTypeClose, MessageTypeSync, MessageTypeFlush:
+	default:
+		batch.write = true
+	}
+	return isExtendedRequest(GetMessageType(msg)) && !batch.write && batch.size <= MaxSplitBatchSize
+}
+
+// ReadOnly reports whether the held back messages only read.
+func (batch *splitBatch) ReadOnly() bool {
+	return batch.read && !batch.write && batch.size <= MaxSplitBatchSize
+}
+
+// readOnly reports whether a frontend message starting a query cycle only reads.
+func (proxy *PostgresProxy) readOnly(msg []byte) bool {
+	functions := proxy.Config.Clusters[proxy.Route.Cluster].ReadOnlyFunctions
+	switch GetMessageType(msg) {
+	case MessageTypeQuery:
+		return IsReadOnlyQuery(GetQuery(msg), functions)
+	case MessageTypeParse:
+		_, query, _, err := GetParseMessage(msg)
+		return err == nil && IsReadOnlyQuery(query, functions)
+	case MessageTypeBind:
+		_, name, _, err := GetBindMessage(msg)
+		if err != nil || proxy.statements == nil {
+			return false
+		}
+		query, ok := proxy.statements.Query(name)
+		return ok && IsReadOnlyQuery(query, functions)
+	}
+	return false
+}
+
+// splitPool returns the pool of a standby when the query cycle that is starting is read-only and can run on one.
+func (proxy *PostgresProxy) splitPool(readOnly bool) *Pool {
+	if proxy.split == nil || !proxy.split.Attach(readOnly) {
+		return proxy.pool
+	}
+	standby, err := proxy.Replicas.Select(proxy.Route.Cluster, proxy.Route.MaxReplicaLag)
+	if err != nil {
+		// Reads fall back to the primary, e.g. when every standby lags too far behind
+		return proxy.pool
+	}
+	pool, err := proxy.Pools.Pool(proxy.Router.WithBackend(proxy.Route, standby))
+	if err != nil {
+		return proxy.pool
+	}
+	return pool
+}
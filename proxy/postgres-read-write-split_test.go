@@ -0,0 +1,186 @@
+package main
+
+import (
+	"testing"
+)
+
+func newSplitTestProxy() *PostgresProxy {
+	return &PostgresProxy{
+		Config:     &Config{Clusters: map[string]*ClusterConfig{"main": {ReadOnlyFunctions: []string{"report"}}}},
+		Route:      &Route{Cluster: "main", ReadWriteSplit: true},
+		split:      &SplitState{},
+		statements: NewStatementTracker(),
+	}
+}
+
+func testParse(t *testing.T, name, query string) []byte {
+	msg, err := CreateParseMessage(name, query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func testBind(t *testing.T, statement string) []byte {
+	// No parameter formats, no parameters, no result formats
+	msg, err := CreateBindMessage("", statement, []byte{0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func testMessage(t *testing.T, messageType byte) []byte {
+	if messageType == MessageTypeExecute {
+		// Unnamed portal, no row limit
+		return []byte{MessageTypeExecute, 0, 0, 0, 9, 0, 0, 0, 0, 0}
+	}
+	msg, err := CompleteMessage(messageType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages func(t *testing.T) [][]byte
+		// Messages held back when the batch ends
+		held     int
+		readOnly bool
+	}{
+		{
+			name: "pipelined reads",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{
+					testParse(t, "", "SELECT 1"), testBind(t, ""), testMessage(t, MessageTypeExecute),
+					testParse(t, "", "SELECT count(*) FROM t"), testBind(t, ""), testMessage(t, MessageTypeExecute),
+					testMessage(t, MessageTypeSync),
+				}
+			},
+			held:     7,
+			readOnly: true,
+		},
+		{
+			name: "pipelined read then insert",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{
+					testParse(t, "", "SELECT 1"), testBind(t, ""), testMessage(t, MessageTypeExecute),
+					testParse(t, "", "INSERT INTO t VALUES (1)"), testBind(t, ""), testMessage(t, MessageTypeExecute),
+					testMessage(t, MessageTypeSync),
+				}
+			},
+			held:     4,
+			readOnly: false,
+		},
+		{
+			name: "named statement parsed in the batch",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{
+					testParse(t, "s1", "SELECT 1"), testMessage(t, MessageTypeSync),
+				}
+			},
+			held:     2,
+			readOnly: true,
+		},
+		{
+			name: "bind of a statement parsed in the batch",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{
+					testParse(t, "s1", "SELECT 1"), testBind(t, "s1"), testMessage(t, MessageTypeExecute),
+					testMessage(t, MessageTypeSync),
+				}
+			},
+			held:     4,
+			readOnly: true,
+		},
+		{
+			name: "bind of an unknown statement",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{testBind(t, "unknown"), testMessage(t, MessageTypeExecute), testMessage(t, MessageTypeSync)}
+			},
+			held:     1,
+			readOnly: false,
+		},
+		{
+			name: "bind of a tracked read-only statement",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{testBind(t, "tracked"), testMessage(t, MessageTypeExecute), testMessage(t, MessageTypeSync)}
+			},
+			held:     3,
+			readOnly: true,
+		},
+		{
+			name: "flush ends the batch",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{
+					testParse(t, "", "SELECT 1"), testMessage(t, MessageTypeFlush),
+					testParse(t, "", "DELETE FROM t"),
+				}
+			},
+			held:     2,
+			readOnly: true,
+		},
+		{
+			name: "function that writes",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{testParse(t, "", "SELECT nextval('s')"), testMessage(t, MessageTypeSync)}
+			},
+			held:     1,
+			readOnly: false,
+		},
+		{
+			name: "read-only function from the configuration",
+			messages: func(t *testing.T) [][]byte {
+				return [][]byte{testParse(t, "", "SELECT report()"), testMessage(t, MessageTypeSync)}
+			},
+			held:     2,
+			readOnly: true,
+		},
+		{
+			name: "describe only",
+			messages: func(t *testing.T) [][]byte {
+				describe, err := CreateTargetMessage(MessageTypeDescribe, TargetPortal, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return [][]byte{describe, testMessage(t, MessageTypeSync)}
+			},
+			held:     2,
+			readOnly: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := newSplitTestProxy()
+			proxy.statements.statements["tracked"] = &PreparedStatement{Query: "SELECT 2"}
+			batch := &splitBatch{parsed: make(map[string]bool)}
+			for _, msg := range test.messages(t) {
+				if !batch.Add(proxy, msg) {
+					break
+				}
+			}
+			if len(batch.messages) != test.held {
+				t.Errorf("held %d messages, want %d", len(batch.messages), test.held)
+			}
+			if batch.ReadOnly() != test.readOnly {
+				t.Errorf("ReadOnly() = %v, want %v", batch.ReadOnly(), test.readOnly)
+			}
+		})
+	}
+}
+
+func TestSplitBatchSizeLimit(t *testing.T) {
+	proxy := newSplitTestProxy()
+	batch := &splitBatch{parsed: make(map[string]bool)}
+	msg := testParse(t, "", "SELECT 1")
+	for batch.Add(proxy, msg) {
+	}
+	if batch.size <= MaxSplitBatchSize {
+		t.Fatalf("batch ended at %d bytes, below MaxSplitBatchSize", batch.size)
+	}
+	if batch.ReadOnly() {
+		t.Error("a batch over MaxSplitBatchSize is read-only")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Router
+ *
+ * Picks the backend cluster for a client from its startup attributes
+ * (database, user, application_name) and, when TLS is used, the SNI hostname.
+ * Routes are evaluated in order, the first match wins, and the default route (if any) catches the rest.
+ * The routes can be replaced at run time with RELOAD on the admin console.
+ */
+
+var ErrNoRoute = errors.New("no route")
+
+type Route struct {
+	// Cluster the route resolved through, empty for routes to a fixed backend
+	Cluster        string
+	ReadWriteSplit bool
+	MaxReplicaLag  time.Duration
+	BackendName    string
+	Backend        *BackendConfig
+	// Credentials and database name sent to the backend in the startup message
+	Username string
+	Password string
+	Database string
+	// The credentials come from a certificate identity mapping rather than the backend
+	MappedCredentials bool
+}
+
+type RouteRequest struct {
+	Database        string
+	User            string
+	ApplicationName string
+	ServerName      string
+}
+
+type Router struct {
+	backends     map[string]*BackendConfig
+	mutex        sync.RWMutex
+	routes       []*RouteConfig
+	defaultRoute *RouteConfig
+	health       *HealthChecker
+}
+
+func NewRouter(config *Config, health *HealthChecker) *Router {
+	return &Router{
+		backends:     config.Backends,
+		routes:       config.Routes,
+		defaultRoute: config.DefaultRoute,
+		health:       health,
+	}
+}
+
+// NewRouteRequest builds a route request from the startup message attributes.
+// As in libpq, the database defaults to the user name when it is not given.
+func NewRouteRequest(attributes map[string]string, serverName string) RouteRequest {
+	request := RouteRequest{
+		Database:        attributes[ConnectionAttributeDatabase],
+		User:            attributes[ConnectionAttributeUser],
+		ApplicationName: attributes[ConnectionAttributeApplicationName],
+		ServerName:      serverName,
+	}
+	if request.Database == "" {
+		request.Database = request.User
+	}
+	return request
+}
+
+// Routes returns the routes and the default route in use.
+func (router *Router) Routes() ([]*RouteConfig, *RouteConfig) {
+	router.mutex.RLock()
+	defer router.mutex.RUnlock()
+	return router.routes, router.defaultRoute
+}
+
+// AllRoutes returns the routes in use followed by the default route, as Config.AllRoutes.
+func (router *Router) AllRoutes() []*RouteConfig {
+	routes, defaultRoute := router.Routes()
+	config := Config{Routes: routes, DefaultRoute: defaultRoute}
+	return config.AllRoutes()
+}
+
+// Update replaces the routes, sessions already routed keep their backend.
+func (router *Router) Update(routes []*RouteConfig, defaultRoute *RouteConfig) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.routes, router.defaultRoute = routes, defaultRoute
+}
+
+func (router *Router) Resolve(request RouteRequest) (*Route, error) {
+	routes, defaultRoute := router.Routes()
+	for _, route := range routes {
+		if route.Matches(request) {
+			return router.route(route, request)
+		}
+	}
+	if defaultRoute != nil {
+		return router.route(defaultRoute, request)
+	}
+	if request.ServerName != "" {
+		return nil, fmt.Errorf("%w for database %q user %q server name %q", ErrNoRoute, request.Database, request.User,
+			request.ServerName)
+	}
+	return nil, fmt.Errorf("%w for database %q user %q", ErrNoRoute, request.Database, request.User)
+}
+
+// route resolves a matched route to its backend, the current primary for routes to a cluster.
+func (router *Router) route(config *RouteConfig, request RouteRequest) (*Route, error) {
+	name := config.Backend
+	if config.Cluster != "" {
+		primary, err := router.health.Primary(config.Cluster)
+		if err != nil {
+			return nil, err
+		}
+		name = primary
+	}
+	backend := router.backends[name]
+	route := &Route{
+		Cluster:        config.Cluster,
+		ReadWriteSplit: config.ReadWriteSplit,
+		MaxReplicaLag:  config.MaxReplicaLag.Duration,
+		BackendName:    name,
+		Backend:        backend,
+		Username:       backend.Username,
+		Password:       backend.Password,
+		Database:       request.Database,
+	}
+	if config.BackendDatabase != "" {
+		route.Database = config.BackendDatabase
+	}
+	return route, nil
+}
+
+// Follow returns the route moved to the current primary of its cluster, or the route itself when it still holds.
+func (router *Router) Follow(route *Route) (*Route, error) {
+	if route.Cluster == "" {
+		return route, nil
+	}
+	primary, err := router.health.Primary(route.Cluster)
+	if errors.Is(err, ErrSeveralPrimaries) {
+		return nil, err
+	}
+	if err != nil || primary == route.BackendName {
+		return route, nil
+	}
+	return router.WithBackend(route, primary), nil
+}
+
+// WithBackend returns a copy of a route that goes to another backend of its cluster.
+func (router *Router) WithBackend(route *Route, name string) *Route {
+	backend := router.backends[name]
+	moved := *route
+	moved.BackendName, moved.Backend = name, backend
+	if !route.MappedCredentials {
+		moved.Username, moved.Password = backend.Username, backend.Password
+	}
+	return &moved
+}
+
+func (config *RouteConfig) Matches(request RouteRequest) bool {
+	return matchAttribute(config.Database, request.Database) &&
+		matchAttribute(config.User, request.User) &&
+		matchAttribute(config.ApplicationName, request.ApplicationName) &&
+		matchServerName(config.ServerName, request.ServerName)
+}
+
+func matchAttribute(pattern, value string) bool {
+	return pattern == "" || pattern == value
+}
+
+// matchServerName compares SNI hostnames case-insensitively and supports a leading "*." wildcard label.
+func matchServerName(pattern, serverName string) bool {
+	if pattern == "" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	serverName = strings.ToLower(serverName)
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return strings.HasSuffix(serverName, suffix) && !strings.Contains(strings.TrimSuffix(serverName, suffix), ".")
+	}
+	return pattern == serverName
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRouterResolve(t *testing.T) {
+	config := &Config{
+		Backends: map[string]*BackendConfig{
+			"reports": {Username: "reporter", Password: "r"},
+			"tenants": {Username: "tenant", Password: "t"},
+			"pg1":     {Username: "postgres", Password: "p"},
+			"pg2":     {Username: "postgres", Password: "p"},
+		},
+		Clusters: map[string]*ClusterConfig{"main": {Backends: []string{"pg1", "pg2"}}},
+		Routes: []*RouteConfig{
+			{Database: "app", User: "reporter", Backend: "reports"},
+			{Database: "app", ApplicationName: "metabase", Backend: "reports", BackendDatabase: "app_replica"},
+			{ServerName: "*.tenants.example.com", Backend: "tenants"},
+			{Database: "app", Cluster: "main", ReadWriteSplit: true, MaxReplicaLag: Duration{5 * time.Second}},
+		},
+	}
+	tests := []struct {
+		name         string
+		request      RouteRequest
+		defaultRoute *RouteConfig
+		backend      string
+		database     string
+		err          error
+	}{
+		{
+			name:     "database and user",
+			request:  RouteRequest{Database: "app", User: "reporter", ApplicationName: "metabase"},
+			backend:  "reports",
+			database: "app",
+		},
+		{
+			name:     "first match wins and rewrites the database",
+			request:  RouteRequest{Database: "app", User: "alice", ApplicationName: "metabase"},
+			backend:  "reports",
+			database: "app_replica",
+		},
+		{
+			name:     "server name wildcard",
+			request:  RouteRequest{Database: "app", User: "alice", ServerName: "acme.Tenants.example.com"},
+			backend:  "tenants",
+			database: "app",
+		},
+		{
+			name:     "server name wildcard matches one label only",
+			request:  RouteRequest{Database: "app", User: "alice", ServerName: "a.acme.tenants.example.com"},
+			backend:  "pg1",
+			database: "app",
+		},
+		{
+			name:     "cluster primary",
+			request:  RouteRequest{Database: "app", User: "alice"},
+			backend:  "pg1",
+			database: "app",
+		},
+		{
+			name:         "default route",
+			request:      RouteRequest{Database: "other", User: "alice"},
+			defaultRoute: &RouteConfig{Backend: "tenants"},
+			backend:      "tenants",
+			database:     "other",
+		},
+		{
+			name:    "no route",
+			request: RouteRequest{Database: "other", User: "alice"},
+			err:     ErrNoRoute,
+		},
+		{
+			name:    "no route for a server name",
+			request: RouteRequest{Database: "other", User: "alice", ServerName: "db.example.com"},
+			err:     ErrNoRoute,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := NewRouter(config, NewHealthChecker(config))
+			router.Update(config.Routes, test.defaultRoute)
+			route, err := router.Resolve(test.request)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("Resolve() error = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if route.BackendName != test.backend || route.Database != test.database {
+				t.Errorf("Resolve() = backend %q database %q, want backend %q database %q", route.BackendName,
+					route.Database, test.backend, test.database)
+			}
+			backend := config.Backends[test.backend]
+			if route.Backend != backend || route.Username != backend.Username || route.Password != backend.Password {
+				t.Errorf("Resolve() = %+v, want the credentials of backend %q", route, test.backend)
+			}
+		})
+	}
+}
+
+func TestRouterResolveClusterState(t *testing.T) {
+	config := &Config{
+		Backends: map[string]*BackendConfig{"pg1": {}, "pg2": {}},
+		Clusters: map[string]*ClusterConfig{"main": {Backends: []string{"pg1", "pg2"}}},
+		Routes:   []*RouteConfig{{Cluster: "main", ReadWriteSplit: true, MaxReplicaLag: Duration{time.Second}}},
+	}
+	config.HealthCheck.Interval = Duration{time.Second}
+	tests := []struct {
+		name    string
+		states  map[string]string
+		backend string
+		err     error
+	}{
+		{name: "primary after failover", states: map[string]string{"pg1": NodeStateDown, "pg2": NodeStateUp}, backend: "pg2"},
+		{name: "no primary", states: map[string]string{"pg1": NodeStateDown, "pg2": NodeStateStandby}, err: ErrNoPrimary},
+		{name: "several primaries", states: map[string]string{"pg1": NodeStateUp, "pg2": NodeStateUp}, err: ErrSeveralPrimaries},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			health := NewHealthChecker(config)
+			for name, state := range test.states {
+				health.nodes[name].State = state
+			}
+			route, err := NewRouter(config, health).Resolve(RouteRequest{Database: "app", User: "alice"})
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("Resolve() error = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if route.BackendName != test.backend || route.Cluster != "main" || !route.ReadWriteSplit ||
+				route.MaxReplicaLag != time.Second {
+				t.Errorf("Resolve() = %+v, want backend %q of cluster main", route, test.backend)
+			}
+		})
+	}
+}
+
+func TestMatchServerName(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		serverName string
+		match      bool
+	}{
+		{pattern: "", serverName: "", match: true},
+		{pattern: "", serverName: "db.example.com", match: true},
+		{pattern: "db.example.com", serverName: "db.example.com", match: true},
+		{pattern: "db.example.com", serverName: "DB.Example.COM", match: true},
+		{pattern: "DB.example.com", serverName: "db.example.com", match: true},
+		{pattern: "db.example.com", serverName: "", match: false},
+		{pattern: "db.example.com", serverName: "db.example.org", match: false},
+		{pattern: "db.example.com", serverName: "xdb.example.com", match: false},
+		{pattern: "*.example.com", serverName: "db.example.com", match: true},
+		{pattern: "*.example.com", serverName: "DB.EXAMPLE.COM", match: true},
+		{pattern: "*.example.com", serverName: "example.com", match: false},
+		{pattern: "*.example.com", serverName: "a.db.example.com", match: false},
+		{pattern: "*.example.com", serverName: "dbexample.com", match: false},
+		{pattern: "*.example.com", serverName: "", match: false},
+	}
+	for _, test := range tests {
+		if match := matchServerName(test.pattern, test.serverName); match != test.match {
+			t.Errorf("matchServerName(%q, %q) = %v, want %v", test.pattern, test.serverName, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+ * Server
+ *
+ * Accepts client connections and registers the sessions they run, so they can be drained on shutdown:
+ * the listener is closed, idle sessions are disconnected at once and the others at their next ReadyForQuery
+ * outside of a transaction. Sessions still running after shutdown_timeout are disconnected with SQLSTATE 57P01,
+ * as PostgreSQL does on a fast shutdown.
+ */
+
+// Time given to disconnected sessions to release their backends before the pools are closed
+const shutdownCloseTimeout = 5 * time.Second
+
+const adminShutdownMessage = "terminating connection due to administrator command"
+
+type Server struct {
+	listener net.Listener
+	// Creates the session of an accepted connection
+	newSession func(net.Conn) *PostgresProxy
+	sessions   *SessionRegistry
+	mutex      sync.Mutex
+	accepting  bool
+	draining   bool
+	running    sync.WaitGroup
+}
+
+func NewServer(listener net.Listener, sessions *SessionRegistry, newSession func(net.Conn) *PostgresProxy) *Server {
+	return &Server{
+		listener:   listener,
+		newSession: newSession,
+		sessions:   sessions,
+	}
+}
+
+// Serve accepts connections until the listener fails or the server shuts down.
+func (server *Server) Serve() error {
+	server.setAccepting(true)
+	defer server.setAccepting(false)
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if server.Draining() && errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		session := server.newSession(conn)
+		connection := server.add(session)
+		log.Printf("session %v: new connection from %v", connection.ID, conn.RemoteAddr())
+		go func() {
+			defer server.remove(connection)
+			session.Connect()
+		}()
+	}
+}
+
+func (server *Server) add(session *PostgresProxy) *Connection {
+	server.mutex.Lock()
+	connection := server.sessions.Add(session)
+	server.running.Add(1)
+	draining := server.draining
+	server.mutex.Unlock()
+	if draining {
+		session.Drain()
+	}
+	return connection
+}
+
+// remove unregisters a session that ended and records it in the audit log.
+func (server *Server) remove(connection *Connection) {
+	info := connection.Info()
+	log.Printf("session %v: closed after %v, user %q database %q application %q from %v, %d bytes received, %d sent",
+		info.ID, time.Since(info.Started).Round(time.Millisecond), info.User, info.Database, info.ApplicationName,
+		info.ClientAddr, info.BytesReceived, info.BytesSent)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.sessions.Remove(connection)
+	server.running.Done()
+}
+
+func (server *Server) Sessions() (sessions []*PostgresProxy) {
+	for _, connection := range server.sessions.Connections() {
+		sessions = append(sessions, connection.Session())
+	}
+	return sessions
+}
+
+func (server *Server) setAccepting(accepting bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.accepting = accepting
+}
+
+// Accepting reports whether the server accepts connections.
+func (server *Server) Accepting() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.accepting && !server.draining
+}
+
+// Draining reports whether the server is shutting down.
+func (server *Server) Draining() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.draining
+}
+
+/**
+ * Shutdown stops accepting connections and drains the sessions.
+ *
+ * It returns once every session has ended, disconnecting those still running after the timeout.
+ */
+func (server *Server) Shutdown(timeout time.Duration) {
+	server.mutex.Lock()
+	server.draining = true
+	server.mutex.Unlock()
+	_ = server.listener.Close()
+
+	sessions := server.Sessions()
+	log.Printf("shutting down: draining %d sessions, waiting up to %v", len(sessions), timeout)
+	for _, session := range sessions {
+		session.Drain()
+	}
+	done := make(chan struct{})
+	go func() {
+		server.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	sessions = server.Sessions()
+	log.Printf("shutting down: disconnecting %d sessions", len(sessions))
+	for _, session := range sessions {
+		session.Terminate(adminShutdownMessage)
+	}
+	select {
+	case <-done:
+	case <-time.After(shutdownCloseTimeout):
+		log.Printf("shutting down: %d sessions did not end", len(server.Sessions()))
+	}
+}
+
+/**
+ * Drain ends the session as soon as it is idle: at once if it is, else at its next ReadyForQuery
+ * outside of a transaction (see relayBackend). Sessions still in the startup handshake end when it completes.
+ */
+func (proxy *PostgresProxy) Drain() {
+	proxy.pmutex.Lock()
+	proxy.draining = true
+	idle := proxy.state != nil && proxy.state.Idle()
+	proxy.pmutex.Unlock()
+	if idle {
+		proxy.Terminate(adminShutdownMessage)
+	}
+}
+
+// Draining reports whether the session ends at its next ReadyForQuery outside of a transaction.
+func (proxy *PostgresProxy) Draining() bool {
+	proxy.pmutex.Lock()
+	defer proxy.pmutex.Unlock()
+	return proxy.draining
+}
+
+// Terminate sends the frontend a FATAL admin_shutdown error and disconnects it.
+func (proxy *PostgresProxy) Terminate(message string) {
+	proxy.pmutex.Lock()
+	started := proxy.state != nil
+	proxy.pmutex.Unlock()
+	if !started {
+		// The startup handshake may be switching the connection to TLS, close the socket underneath
+		_ = proxy.socket.Close()
+		return
+	}
+	_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateAdminShutdown, message)
+	_ = proxy.ReverseConnection.Close()
+}
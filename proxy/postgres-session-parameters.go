@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/**
+ * Session parameters of pooled clients
+ *
+ * A client's run-time parameters (from its startup message and from the ParameterStatus reports that follow
+ * its SET commands) are tracked by the proxy. When the client is attached to a backend connection whose
+ * reported settings differ, the proxy sets them itself before forwarding the client's message.
+ * The backend's ParameterStatus echoes are consumed by the proxy, so the client keeps seeing the session
+ * it configured.
+ *
+ * Values are set with set_config, which parses them like the server reported them: SET name TO 'value' would
+ * turn a list such as search_path's "$user", public into a single element.
+ */
+
+var DefaultTrackedParameters = []string{
+	ConnectionAttributeApplicationName,
+	"client_encoding",
+	"DateStyle",
+	"IntervalStyle",
+	"TimeZone",
+	"standard_conforming_strings",
+	"search_path",
+}
+
+var parameterNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+type SessionParameters struct {
+	mutex sync.Mutex
+	// Tracked parameter names, by lower case name
+	tracked map[string]string
+	// Client values, by lower case name
+	values map[string]string
+}
+
+func NewSessionParameters(tracked []string, startup map[string]string) *SessionParameters {
+	parameters := &SessionParameters{
+		tracked: make(map[string]string),
+		values:  make(map[string]string),
+	}
+	for _, name := range tracked {
+		if parameterNamePattern.MatchString(name) {
+			parameters.tracked[strings.ToLower(name)] = name
+		}
+	}
+	for name, value := range startup {
+		parameters.Update(name, value)
+	}
+	return parameters
+}
+
+// Update records a parameter value of the client, untracked parameters are ignored.
+func (parameters *SessionParameters) Update(name, value string) {
+	key := strings.ToLower(name)
+	parameters.mutex.Lock()
+	defer parameters.mutex.Unlock()
+	if _, ok := parameters.tracked[key]; ok {
+		parameters.values[key] = value
+	}
+}
+
+// Report returns the ParameterStatus values the client should see for a backend.
+func (parameters *SessionParameters) Report(backend map[string]string) map[string]string {
+	parameters.mutex.Lock()
+	defer parameters.mutex.Unlock()
+	report := make(map[string]string)
+	names := make(map[string]string)
+	for name, value := range backend {
+		report[name] = value
+		names[strings.ToLower(name)] = name
+	}
+	for key, value := range parameters.values {
+		name, ok := names[key]
+		if !ok {
+			name = parameters.tracked[key]
+		}
+		report[name] = value
+	}
+	return report
+}
+
+// diff returns the set_config queries that bring the backend's settings in line with the client.
+func (parameters *SessionParameters) diff(backend map[string]string) (commands map[string]string) {
+	parameters.mutex.Lock()
+	defer parameters.mutex.Unlock()
+	current := make(map[string]string)
+	for name, value := range backend {
+		current[strings.ToLower(name)] = value
+	}
+	commands = make(map[string]string)
+	for key, value := range parameters.values {
+		if backendValue, ok := current[key]; ok && backendValue == value {
+			continue
+		}
+		commands[key] = fmt.Sprintf("SELECT pg_catalog.set_config(%v, %v, false)", quoteLiteral(parameters.tracked[key]),
+			quoteLiteral(value))
+	}
+	return commands
+}
+
+// quoteLiteral quotes a string constant as PQescapeLiteral does, whatever standard_conforming_strings is.
+func quoteLiteral(value string) string {
+	quoted := "'" + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), "'", "''") + "'"
+	if strings.Contains(value, `\`) {
+		return "E" + quoted
+	}
+	return quoted
+}
+
+/**
+ * Apply sets the parameters needed on a backend connection before it serves the client.
+ *
+ * The backend's ParameterStatus echo replaces the client's value, so a value the server normalizes
+ * (e.g. 'utc' reported back as 'UTC') isn't set again on the next backend. Values the backend rejects
+ * are dropped from the session.
+ */
+func (parameters *SessionParameters) Apply(pg *PGConnection) {
+	for key, command := range parameters.diff(pg.parameters) {
+		if err := pg.Exec(command); err != nil {
+			log.Printf("could not replay session parameter: %v", err)
+			parameters.mutex.Lock()
+			delete(parameters.values, key)
+			parameters.mutex.Unlock()
+			continue
+		}
+		for name, value := range pg.parameters {
+			if strings.ToLower(name) == key {
+				parameters.Update(name, value)
+			}
+		}
+	}
+}
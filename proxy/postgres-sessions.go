@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Session registry
+ *
+ * Every accepted connection is registered under a unique ID until it closes. The registry is what the admin
+ * console, the metrics and the audit log read: who is connected from where and over which TLS version, which
+ * backend serves the session, what it is doing, how much it transferred and what it ran last.
+ */
+
+// Query texts are recorded up to this length, as track_activity_query_size does in PostgreSQL
+const MaxRecordedQueryLength = 1024
+
+// State of a session that has not completed its startup handshake
+const SessionStateLogin = "login"
+
+// Session states reported by the metrics, see TransactionState.Activity
+var SessionStates = []string{SessionStateLogin, "active", "idle", "idle in transaction", "idle in transaction (aborted)"}
+
+type SessionRegistry struct {
+	mutex       sync.Mutex
+	connections map[string]*Connection
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{connections: make(map[string]*Connection)}
+}
+
+// Connection is the registry entry of a session.
+type Connection struct {
+	ID         string
+	ClientAddr net.Addr
+	Started    time.Time
+	session    *PostgresProxy
+	// Message bytes received from and sent to the client, counted by the session's ReverseConnection
+	BytesReceived atomic.Uint64
+	BytesSent     atomic.Uint64
+	mutex         sync.Mutex
+	login         ConnectionLogin
+	lastQuery     string
+	lastQueryAt   time.Time
+}
+
+// ConnectionLogin is what a client told about itself in the startup handshake.
+type ConnectionLogin struct {
+	User            string
+	Database        string
+	ApplicationName string
+	// TLS version, empty for plaintext connections, and the SNI server name
+	TLS        string
+	ServerName string
+}
+
+// ConnectionInfo is a snapshot of a registry entry and of the session's current state.
+type ConnectionInfo struct {
+	ConnectionLogin
+	ID            string
+	ClientAddr    net.Addr
+	Started       time.Time
+	State         string
+	BytesReceived uint64
+	BytesSent     uint64
+	LastQuery     string
+	LastQueryAt   time.Time
+	// Backend serving the session, and the process ID of the attached backend connection, 0 if none is
+	Backend    string
+	BackendPID int32
+	pool       *Pool
+	server     *PGConnection
+}
+
+// Add registers the session of an accepted connection under a new ID.
+func (registry *SessionRegistry) Add(session *PostgresProxy) *Connection {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	connection := &Connection{
+		ClientAddr: session.socket.RemoteAddr(),
+		Started:    time.Now(),
+		session:    session,
+	}
+	for {
+		random := make([]byte, 6)
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
+		}
+		connection.ID = hex.EncodeToString(random)
+		if _, ok := registry.connections[connection.ID]; !ok {
+			break
+		}
+	}
+	registry.connections[connection.ID] = connection
+	session.connection = connection
+	frontend := session.ReverseConnection
+	frontend.received, frontend.sent = &connection.BytesReceived, &connection.BytesSent
+	return connection
+}
+
+func (registry *SessionRegistry) Remove(connection *Connection) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	delete(registry.connections, connection.ID)
+}
+
+// Get returns the entry registered under an ID, nil if there is none.
+func (registry *SessionRegistry) Get(id string) *Connection {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.connections[id]
+}
+
+// Connections returns the entries, oldest first.
+func (registry *SessionRegistry) Connections() (connections []*Connection) {
+	registry.mutex.Lock()
+	for _, connection := range registry.connections {
+		connections = append(connections, connection)
+	}
+	registry.mutex.Unlock()
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].Started.Before(connections[j].Started)
+	})
+	return connections
+}
+
+// Info returns a snapshot of every entry, oldest first.
+func (registry *SessionRegistry) Info() (infos []ConnectionInfo) {
+	for _, connection := range registry.Connections() {
+		infos = append(infos, connection.Info())
+	}
+	return infos
+}
+
+// Session returns the session the entry was registered for.
+func (connection *Connection) Session() *PostgresProxy {
+	return connection.session
+}
+
+// Login records the startup attributes of a client that completed its handshake.
+func (connection *Connection) Login(login ConnectionLogin) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.login = login
+}
+
+// Query records the query text of a Query or Parse message.
+func (connection *Connection) Query(query string) {
+	if len(query) > MaxRecordedQueryLength {
+		query = query[:MaxRecordedQueryLength]
+	}
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.lastQuery, connection.lastQueryAt = query, time.Now()
+}
+
+func (connection *Connection) Info() ConnectionInfo {
+	connection.mutex.Lock()
+	info := ConnectionInfo{
+		ConnectionLogin: connection.login,
+		ID:              connection.ID,
+		ClientAddr:      connection.ClientAddr,
+		Started:         connection.Started,
+		State:           SessionStateLogin,
+		BytesReceived:   connection.BytesReceived.Load(),
+		BytesSent:       connection.BytesSent.Load(),
+		LastQuery:       connection.lastQuery,
+		LastQueryAt:     connection.lastQueryAt,
+	}
+	connection.mutex.Unlock()
+
+	session := connection.session
+	session.pmutex.Lock()
+	defer session.pmutex.Unlock()
+	if session.state != nil {
+		info.State = session.state.Activity()
+	}
+	info.pool, info.server = session.pool, session.ForwardConnection
+	if info.pool != nil {
+		info.Backend = info.pool.Key.Backend
+	}
+	if info.server != nil {
+		info.BackendPID = info.server.processID
+	}
+	return info
+}
+
+// login records the session's startup attributes in its registry entry.
+func (proxy *PostgresProxy) login() {
+	frontend := proxy.ReverseConnection
+	proxy.connection.Login(ConnectionLogin{
+		User:            frontend.username,
+		Database:        NewRouteRequest(frontend.attributes, "").Database,
+		ApplicationName: frontend.application,
+		TLS:             tlsVersion(frontend.Conn),
+		ServerName:      proxy.ServerName(),
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"strings"
+)
+
+/**
+ * SQL statement classification
+ *
+ * Decides whether a query string is read-only, so read/write splitting can send it to a standby.
+ * The query is lexed just enough to skip comments, string literals and quoted identifiers,
+ * then every statement is judged by its keywords. Anything the lexer isn't sure about is a write.
+ *
+ * Functions may write or take locks whatever statement calls them, so a call only reads when the
+ * function is a built-in known to, or is listed in the cluster's read_only_functions.
+ */
+
+// Leading keywords of statements that can run on a standby
+var readOnlyStatements = map[string]bool{
+	"SELECT": true,
+	"VALUES": true,
+	"TABLE":  true,
+	"SHOW":   true,
+	"WITH":   true,
+}
+
+// Keywords that make an otherwise read-only statement write or lock
+var writeKeywords = map[string]bool{
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"MERGE":  true,
+	"INTO":   true, // SELECT ... INTO creates a table
+	"FOR":    true, // FOR UPDATE / FOR SHARE take row locks
+}
+
+// Keywords and type names followed by a parenthesis that isn't a function call
+var parenthesizedKeywords = wordSet(
+	"SELECT", "VALUES", "FROM", "JOIN", "LATERAL", "ON", "USING", "WHERE", "HAVING", "AND", "OR", "NOT", "IN",
+	"EXISTS", "ANY", "ALL", "SOME", "AS", "MATERIALIZED", "OVER", "FILTER", "GROUP", "BY", "UNION", "INTERSECT",
+	"EXCEPT", "DISTINCT", "CASE", "WHEN", "THEN", "ELSE", "IS", "LIKE", "ILIKE", "BETWEEN", "LIMIT", "OFFSET",
+	"ROW", "ARRAY", "CAST", "NUMERIC", "DECIMAL", "VARCHAR", "CHAR", "CHARACTER", "VARYING", "BIT", "FLOAT",
+	"TIME", "TIMESTAMP", "TIMESTAMPTZ", "INTERVAL",
+)
+
+// Built-in functions that neither write nor lock
+var readOnlyFunctions = wordSet(
+	"COUNT", "SUM", "AVG", "MIN", "MAX", "ARRAY_AGG", "STRING_AGG", "JSON_AGG", "JSONB_AGG", "JSON_OBJECT_AGG",
+	"JSONB_OBJECT_AGG", "BOOL_AND", "BOOL_OR", "EVERY", "ROW_NUMBER", "RANK", "DENSE_RANK", "PERCENT_RANK",
+	"CUME_DIST", "NTILE", "LAG", "LEAD", "FIRST_VALUE", "LAST_VALUE", "NTH_VALUE", "PERCENTILE_CONT",
+	"PERCENTILE_DISC", "MODE", "COALESCE", "NULLIF", "GREATEST", "LEAST", "LOWER", "UPPER", "INITCAP", "LENGTH",
+	"CHAR_LENGTH", "OCTET_LENGTH", "SUBSTRING", "SUBSTR", "POSITION", "STRPOS", "TRIM", "BTRIM", "LTRIM", "RTRIM",
+	"LPAD", "RPAD", "REPLACE", "TRANSLATE", "REVERSE", "REPEAT", "CONCAT", "CONCAT_WS", "LEFT", "RIGHT",
+	"SPLIT_PART", "FORMAT", "QUOTE_IDENT", "QUOTE_LITERAL", "REGEXP_REPLACE", "REGEXP_MATCH", "REGEXP_MATCHES",
+	"MD5", "ENCODE", "DECODE", "TO_CHAR", "TO_DATE", "TO_TIMESTAMP", "TO_NUMBER", "DATE_TRUNC", "DATE_PART",
+	"EXTRACT", "AGE", "NOW", "MAKE_DATE", "MAKE_INTERVAL", "ABS", "CEIL", "CEILING", "FLOOR", "ROUND", "TRUNC",
+	"MOD", "POWER", "SQRT", "EXP", "LN", "LOG", "SIGN", "RANDOM", "GEN_RANDOM_UUID", "ARRAY_LENGTH", "CARDINALITY",
+	"ARRAY_POSITION", "ARRAY_TO_STRING", "STRING_TO_ARRAY", "UNNEST", "GENERATE_SERIES", "TO_JSON", "TO_JSONB",
+	"ROW_TO_JSON", "JSON_BUILD_OBJECT", "JSONB_BUILD_OBJECT", "JSON_BUILD_ARRAY", "JSONB_BUILD_ARRAY",
+	"JSON_EXTRACT_PATH", "JSON_EXTRACT_PATH_TEXT", "JSONB_EXTRACT_PATH", "JSONB_EXTRACT_PATH_TEXT",
+	"JSON_ARRAY_ELEMENTS", "JSONB_ARRAY_ELEMENTS", "JSON_ARRAY_LENGTH", "JSONB_ARRAY_LENGTH", "JSONB_SET",
+	"CURRENT_SETTING", "VERSION", "PG_IS_IN_RECOVERY", "PG_BACKEND_PID",
+)
+
+func wordSet(list ...string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, word := range list {
+		set[word] = true
+	}
+	return set
+}
+
+/**
+ * IsReadOnlyQuery reports whether every statement in a query only reads.
+ *
+ * Empty statements don't count either way, but a query without any other statement is not read-only.
+ * Functions is the cluster's read_only_functions, names as they are called, e.g. "report" or "stats.report".
+ */
+func IsReadOnlyQuery(query string, functions []string) bool {
+	read := false
+	for _, words := range lexStatements(query) {
+		if len(words) == 0 {
+			continue
+		}
+		if !readOnlyStatements[words[0]] {
+			return false
+		}
+		for i, word := range words[1:] {
+			if writeKeywords[word] {
+				return false
+			}
+			// words[i] precedes word
+			if word == "(" && !readOnlyCall(words[:i+1], functions) {
+				return false
+			}
+		}
+		read = true
+	}
+	return read
+}
+
+// readOnlyCall reports whether the parenthesis after words opens the arguments of a read-only function.
+func readOnlyCall(words []string, functions []string) bool {
+	name := words[len(words)-1]
+	if parenthesizedKeywords[name] {
+		return true
+	}
+	if len(words) > 1 {
+		switch words[len(words)-2] {
+		case "AS", "WITH", "RECURSIVE":
+			// Column names of an alias or a common table expression
+			return true
+		}
+	}
+	if readOnlyFunctions[strings.TrimPrefix(name, "PG_CATALOG.")] {
+		return true
+	}
+	for _, function := range functions {
+		if strings.EqualFold(function, name) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * lexStatements splits a query into statements of upper-cased bare words.
+ *
+ * Comments and string literals (including E'' and dollar-quoted strings) are skipped, quoted identifiers
+ * become a `"` word. Qualified names are one word, e.g. PG_CATALOG.COUNT, and a parenthesis right after
+ * a name is a "(" word, as in a function call. A nil result means the query could not be lexed, e.g. an
+ * unterminated literal.
+ */
+func lexStatements(query string) (statements [][]string) {
+	var words []string
+	// The last word is a name that a parenthesis would call
+	named := false
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 1
+			}
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			// Block comments nest in PostgreSQL
+			depth := 0
+			for i < len(query) {
+				if strings.HasPrefix(query[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(query[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			if depth != 0 {
+				return nil
+			}
+			continue
+		case c == '\'' || c == '"':
+			end := skipQuoted(query, i, c, i > 0 && (query[i-1] == 'E' || query[i-1] == 'e'))
+			if end < 0 {
+				return nil
+			}
+			i = end
+			named = c == '"'
+			if named {
+				words = append(words, `"`)
+			}
+			continue
+		case c == '$':
+			end := skipDollarQuoted(query, i)
+			if end < 0 {
+				return nil
+			}
+			i = end
+		case c == ';':
+			statements = append(statements, words)
+			words = nil
+			i++
+		case c == '(' && named:
+			words = append(words, "(")
+			i++
+		case isWordByte(c):
+			start := i
+			for i < len(query) && (isWordByte(query[i]) || query[i] == '$' ||
+				(query[i] == '.' && i+1 < len(query) && isWordByte(query[i+1]))) {
+				i++
+			}
+			words = append(words, strings.ToUpper(query[start:i]))
+			named = true
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+			continue
+		default:
+			i++
+		}
+		named = false
+	}
+	if len(words) > 0 || len(statements) == 0 {
+		statements = append(statements, words)
+	}
+	return statements
+}
+
+// skipQuoted returns the position after a quoted literal or identifier starting at start, -1 if it isn't terminated.
+func skipQuoted(query string, start int, quote byte, escapes bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if escapes {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// skipDollarQuoted returns the position after a $tag$...$tag$ string, or after a lone $n parameter.
+func skipDollarQuoted(query string, start int) int {
+	end := strings.IndexByte(query[start+1:], '$')
+	if end < 0 {
+		return start + 1
+	}
+	tag := query[start : start+end+2]
+	for n, c := range []byte(tag[1 : len(tag)-1]) {
+		if !isWordByte(c) || (n == 0 && c >= '0' && c <= '9') {
+			// A $1 style parameter, not a dollar-quoted string
+			return start + 1
+		}
+	}
+	body := strings.Index(query[start+len(tag):], tag)
+	if body < 0 {
+		return -1
+	}
+	return start + len(tag) + body + len(tag)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLexStatements(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		statements [][]string
+	}{
+		{name: "words", query: "select a from t", statements: [][]string{{"SELECT", "A", "FROM", "T"}}},
+		{name: "empty", query: "", statements: [][]string{nil}},
+		{name: "statements", query: "SELECT 1; SELECT 2;", statements: [][]string{{"SELECT", "1"}, {"SELECT", "2"}}},
+		{name: "line comment", query: "SELECT 1 -- ; DELETE\n", statements: [][]string{{"SELECT", "1"}}},
+		{name: "block comment", query: "SELECT /* ; DELETE */ 1", statements: [][]string{{"SELECT", "1"}}},
+		{name: "nested block comment", query: "SELECT /* /* */ ; */ 1", statements: [][]string{{"SELECT", "1"}}},
+		{name: "unterminated block comment", query: "SELECT /* /* */ 1", statements: nil},
+		{name: "string literal", query: "SELECT 'a;b''c'", statements: [][]string{{"SELECT"}}},
+		{name: "escape string", query: `SELECT E'a\';DELETE'`, statements: [][]string{{"SELECT", "E"}}},
+		{name: "backslash in a standard string", query: `SELECT 'a\'; DELETE`, statements: [][]string{{"SELECT"}, {"DELETE"}}},
+		{name: "unterminated string", query: "SELECT 'a", statements: nil},
+		{name: "dollar quote", query: "SELECT $$;DELETE$$", statements: [][]string{{"SELECT"}}},
+		{name: "tagged dollar quote", query: "SELECT $x$ $$; $x$, 1", statements: [][]string{{"SELECT", "1"}}},
+		{name: "unterminated dollar quote", query: "SELECT $x$ 1", statements: nil},
+		{name: "parameter", query: "SELECT $1, $2", statements: [][]string{{"SELECT", "1", "2"}}},
+		{name: "quoted identifier", query: `SELECT "a;b"(1)`, statements: [][]string{{"SELECT", `"`, "(", "1"}}},
+		{name: "function call", query: "SELECT pg_catalog.count(*)", statements: [][]string{{"SELECT", "PG_CATALOG.COUNT", "("}}},
+		{name: "parenthesis after a space", query: "SELECT count (*)", statements: [][]string{{"SELECT", "COUNT", "("}}},
+		{name: "parenthesis after an operator", query: "SELECT 1 + (2)", statements: [][]string{{"SELECT", "1", "2"}}},
+		{name: "subquery", query: "SELECT 1 FROM (SELECT 1) s", statements: [][]string{{"SELECT", "1", "FROM", "(", "SELECT", "1", "S"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if statements := lexStatements(test.query); !reflect.DeepEqual(statements, test.statements) {
+				t.Errorf("lexStatements(%q) = %q, want %q", test.query, statements, test.statements)
+			}
+		})
+	}
+}
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		functions []string
+		readOnly  bool
+	}{
+		{query: "SELECT 1", readOnly: true},
+		{query: "select * from t where a = 1", readOnly: true},
+		{query: "VALUES (1), (2)", readOnly: true},
+		{query: "TABLE t", readOnly: true},
+		{query: "SHOW search_path", readOnly: true},
+		{query: "SELECT 1; SELECT 2", readOnly: true},
+		{query: "SELECT 1;;", readOnly: true},
+		{query: "", readOnly: false},
+		{query: ";", readOnly: false},
+		{query: "-- SELECT 1", readOnly: false},
+		{query: "INSERT INTO t VALUES (1)", readOnly: false},
+		{query: "SELECT 1; DELETE FROM t", readOnly: false},
+		{query: "BEGIN", readOnly: false},
+		{query: "SET search_path = a", readOnly: false},
+
+		// Comments and literals hide what they contain
+		{query: "SELECT 1 -- FOR UPDATE", readOnly: true},
+		{query: "SELECT /* DELETE */ 1", readOnly: true},
+		{query: "/* INSERT */ SELECT 1", readOnly: true},
+		{query: "SELECT 'INSERT INTO t'", readOnly: true},
+		{query: `SELECT E'\'; DELETE FROM t; --'`, readOnly: true},
+		{query: `SELECT '\'; DELETE FROM t; --'`, readOnly: false},
+		{query: "SELECT $$; DELETE FROM t; $$", readOnly: true},
+		{query: "SELECT $body$ $$; DELETE $$ $body$", readOnly: true},
+		{query: `SELECT "delete" FROM t`, readOnly: true},
+		{query: "SELECT 'unterminated", readOnly: false},
+		{query: "SELECT $$unterminated", readOnly: false},
+
+		// Row locks and SELECT INTO
+		{query: "SELECT * FROM t FOR UPDATE", readOnly: false},
+		{query: "SELECT * FROM t FOR SHARE", readOnly: false},
+		{query: "SELECT * FROM t FOR NO KEY UPDATE SKIP LOCKED", readOnly: false},
+		{query: "SELECT * INTO t2 FROM t", readOnly: false},
+
+		// Common table expressions
+		{query: "WITH a AS (SELECT 1) SELECT * FROM a", readOnly: true},
+		{query: "WITH a (x) AS (SELECT 1) SELECT x FROM a", readOnly: true},
+		{query: "WITH RECURSIVE r (n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM r WHERE n < 3) SELECT n FROM r", readOnly: true},
+		{query: "WITH a AS MATERIALIZED (SELECT 1) SELECT * FROM a", readOnly: true},
+		{query: "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", readOnly: false},
+		{query: "WITH u AS (UPDATE t SET a = 1 RETURNING a) SELECT a FROM u", readOnly: false},
+		{query: "WITH i AS (INSERT INTO t VALUES (1) RETURNING a) SELECT a FROM i", readOnly: false},
+
+		// Function calls
+		{query: "SELECT count(*), max(a) FROM t", readOnly: true},
+		{query: "SELECT pg_catalog.now()", readOnly: true},
+		{query: "SELECT coalesce(a, 0)::numeric(10, 2) FROM t", readOnly: true},
+		{query: "SELECT a FROM t WHERE a IN (SELECT b FROM u)", readOnly: true},
+		{query: "SELECT nextval('s')", readOnly: false},
+		{query: "SELECT setval('s', 1)", readOnly: false},
+		{query: "SELECT pg_advisory_lock(1)", readOnly: false},
+		{query: "SELECT report()", readOnly: false},
+		{query: "SELECT report()", functions: []string{"report"}, readOnly: true},
+		{query: "SELECT REPORT(1)", functions: []string{"report"}, readOnly: true},
+		{query: "SELECT stats.report()", functions: []string{"report"}, readOnly: false},
+		{query: "SELECT stats.report()", functions: []string{"stats.report"}, readOnly: true},
+		{query: "SELECT report()", functions: []string{"stats.report"}, readOnly: false},
+		{query: `SELECT "report"()`, functions: []string{"report"}, readOnly: false},
+	}
+	for _, test := range tests {
+		if readOnly := IsReadOnlyQuery(test.query, test.functions); readOnly != test.readOnly {
+			t.Errorf("IsReadOnlyQuery(%q, %q) = %v, want %v", test.query, test.functions, readOnly, test.readOnly)
+		}
+	}
+}
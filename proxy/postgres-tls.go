@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+)
+
+/**
+ * Frontend TLS policy
+ *
+ * The TLS configuration of the frontend leg is built at startup from the "tls" section:
+ * whether clients must use SSL, the minimum protocol version, the TLS 1.2 cipher suites and
+ * whether clients must present a certificate signed by the configured client CA.
+ * The certificates themselves come from the CertificateManager.
+ *
+ * Besides the SSLRequest exchange, clients may start TLS at once (PostgreSQL 17 sslnegotiation=direct).
+ * Such connections must negotiate the postgresql ALPN protocol.
+ */
+
+const (
+	FrontendSSLDisable = "disable"
+	FrontendSSLAllow   = "allow"
+	FrontendSSLRequire = "require"
+)
+
+const (
+	ClientCertificatesNone     = "none"
+	ClientCertificatesOptional = "optional"
+	ClientCertificatesRequired = "required"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/**
+ * NewFrontendTLSConfig builds the server side TLS configuration, nil when SSL is disabled.
+ *
+ * The certificate and client CAs are looked up on every handshake, so rotated material is picked up.
+ * The certificate is chosen by the SNI server name of the ClientHello, which also selects the route.
+ */
+func NewFrontendTLSConfig(config *Config, certificates *CertificateManager) (*tls.Config, error) {
+	policy := config.TLS
+	if policy.Mode == FrontendSSLDisable {
+		return nil, nil
+	}
+	base := &tls.Config{
+		MinVersion: tlsVersions[policy.MinVersion],
+		// Clients offering other ALPN protocols fail the handshake with no_application_protocol
+		NextProtos: []string{ALPNProtocolPostgreSQL},
+	}
+	for _, name := range policy.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		base.CipherSuites = append(base.CipherSuites, id)
+	}
+	switch policy.ClientCertificates {
+	case ClientCertificatesOptional:
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientCertificatesRequired:
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: base.MinVersion,
+		NextProtos: base.NextProtos,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			crt, err := certificates.ServerCertificate(hello.ServerName)
+			if err != nil {
+				return nil, err
+			}
+			handshake := base.Clone()
+			handshake.Certificates = []tls.Certificate{*crt}
+			handshake.ClientCAs = certificates.ClientCAs()
+			return handshake, nil
+		},
+	}, nil
+}
+
+// cipherSuite looks up a cipher suite by its Go (IANA) name, insecure suites are refused.
+func cipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %v is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %v", name)
+}
+
+// prefixConn returns bytes read ahead of the connection before reading on.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *prefixConn) Read(b []byte) (int, error) {
+	if len(conn.prefix) == 0 {
+		return conn.Conn.Read(b)
+	}
+	n := copy(b, conn.prefix)
+	conn.prefix = conn.prefix[n:]
+	return n, nil
+}
+
+/**
+ * negotiateDirectSSL completes the TLS handshake of a client that starts with a ClientHello.
+ *
+ * Other clients are left untouched, they go on with an SSLRequest or a StartupMessage.
+ */
+func (proxy *PostgresProxy) negotiateDirectSSL() error {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(proxy.ReverseConnection.Conn, first); err != nil {
+		return err
+	}
+	proxy.ReverseConnection.Conn = &prefixConn{Conn: proxy.ReverseConnection.Conn, prefix: first}
+	if first[0] != TLSHandshakeRecordType {
+		return nil
+	}
+	remote := proxy.ReverseConnection.Conn.RemoteAddr()
+	if proxy.TLSConfig == nil {
+		return &handshakeError{reason: HandshakeFailureTLS, err: fmt.Errorf("direct SSL connection from %v, but SSL is disabled", remote)}
+	}
+	if err := proxy.UpgradeReverseConnection(); err != nil {
+		return fmt.Errorf("direct SSL connection from %v: %w", remote, err)
+	}
+	conn := proxy.ReverseConnection.Conn.(*tls.Conn)
+	if conn.ConnectionState().NegotiatedProtocol != ALPNProtocolPostgreSQL {
+		return &handshakeError{reason: HandshakeFailureTLS,
+			err: fmt.Errorf("direct SSL connection from %v without the %v ALPN protocol", remote, ALPNProtocolPostgreSQL)}
+	}
+	return nil
+}
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Tracing
+ *
+ * Client sessions and their query cycles are traced in the OpenTelemetry data model and exported as OTLP/JSON,
+ * to a collector over OTLP/HTTP, or line by line to stdout or a file for offline use:
+ *
+ *   pgproxy session           the client connection, from accept to close
+ *     tls handshake
+ *     backend acquire         taking a connection from the pool, including the wait on a full pool
+ *       backend dial          connecting and logging in to the backend
+ *     authenticate
+ *   <command>                 a query cycle, from the client's Query or Sync to the proxy's ReadyForQuery
+ *     backend query           from the first message sent to the backend to its ReadyForQuery
+ *
+ * The difference between a query cycle and its backend query is the time spent in the proxy.
+ *
+ * A W3C traceparent in application_name continues the client's trace in the session span. A traceparent='00-...'
+ * tag in a query comment, as sqlcommenter adds them, makes the query cycle a child of the client's span,
+ * linked to the session span.
+ */
+
+const (
+	TracingExporterNone   = "none"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+	TracingExporterOTLP   = "otlp"
+)
+
+const DefaultTracingServiceName = "pgproxy"
+
+// OTLP span kinds
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// OTLP status codes
+const (
+	spanStatusError = 2
+)
+
+const (
+	tracingBatchSize     = 512
+	tracingQueueSize     = 8192
+	tracingFlushInterval = 2 * time.Second
+	tracingExportTimeout = 10 * time.Second
+)
+
+var (
+	// A W3C traceparent, version 00
+	traceparentPattern = regexp.MustCompile(`\b00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}\b`)
+	// A traceparent in a sqlcommenter comment
+	queryTraceparentPattern = regexp.MustCompile(`traceparent\s*=\s*'(00-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2})'`)
+)
+
+// TraceContext identifies a span across processes.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// FindTraceparent returns the trace context of the first traceparent in s, e.g. an application_name.
+func FindTraceparent(s string) *TraceContext {
+	match := traceparentPattern.FindStringSubmatch(s)
+	if match == nil {
+		return nil
+	}
+	var context TraceContext
+	if _, err := hex.Decode(context.TraceID[:], []byte(match[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(context.SpanID[:], []byte(match[2])); err != nil {
+		return nil
+	}
+	// All-zero IDs are invalid
+	if context.TraceID == [16]byte{} || context.SpanID == [8]byte{} {
+		return nil
+	}
+	return &context
+}
+
+// FindQueryTraceparent returns the trace context of a traceparent='...' tag in a query comment.
+func FindQueryTraceparent(query string) *TraceContext {
+	if !strings.Contains(query, "traceparent") {
+		return nil
+	}
+	match := queryTraceparentPattern.FindStringSubmatch(query)
+	if match == nil {
+		return nil
+	}
+	return FindTraceparent(match[1])
+}
+
+type Tracer struct {
+	config  TracingConfig
+	export  func([]byte) error
+	spans   chan otlpSpan
+	closing chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+// NewTracer starts the exporter of the tracing configuration, a nil tracer traces nothing.
+func NewTracer(config TracingConfig) (*Tracer, error) {
+	tracer := &Tracer{
+		config:  config,
+		spans:   make(chan otlpSpan, tracingQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	switch config.Exporter {
+	case "", TracingExporterNone:
+		return nil, nil
+	case TracingExporterStdout:
+		tracer.export = func(data []byte) error {
+			_, err := os.Stdout.Write(append(data, '\n'))
+			return err
+		}
+	case TracingExporterFile:
+		file, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+		tracer.export = func(data []byte) error {
+			_, err := file.Write(append(data, '\n'))
+			return err
+		}
+	case TracingExporterOTLP:
+		client := &http.Client{Timeout: tracingExportTimeout}
+		tracer.export = func(data []byte) error {
+			return tracer.post(client, data)
+		}
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", config.Exporter)
+	}
+	go tracer.run()
+	return tracer, nil
+}
+
+// Start starts a span, a child of parent or the root of a new trace when parent is nil.
+func (tracer *Tracer) Start(name string, kind int, parent *TraceContext, start time.Time) *Span {
+	if tracer == nil {
+		return nil
+	}
+	span := &Span{tracer: tracer, name: name, kind: kind, start: start}
+	if parent != nil {
+		span.Context.TraceID = parent.TraceID
+		span.parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(span.Context.TraceID[:])
+	}
+	_, _ = rand.Read(span.Context.SpanID[:])
+	return span
+}
+
+// Close exports the spans ended so far.
+func (tracer *Tracer) Close() {
+	if tracer == nil {
+		return
+	}
+	close(tracer.closing)
+	<-tracer.done
+}
+
+// run exports spans in batches, when a batch is full or every tracingFlushInterval.
+func (tracer *Tracer) run() {
+	defer close(tracer.done)
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-tracer.spans:
+			if batch = append(batch, span); len(batch) >= tracingBatchSize {
+				tracer.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			tracer.flush(batch)
+			batch = nil
+		case <-tracer.closing:
+			for {
+				select {
+				case span := <-tracer.spans:
+					batch = append(batch, span)
+				default:
+					tracer.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (tracer *Tracer) flush(batch []otlpSpan) {
+	if dropped := tracer.dropped.Swap(0); dropped > 0 {
+		log.Printf("tracing: dropped %d spans, the exporter can't keep up", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	data, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			newAttribute("service.name", tracer.config.ServiceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: DefaultTracingServiceName},
+			Spans: batch,
+		}},
+	}}})
+	if err == nil {
+		err = tracer.export(data)
+	}
+	if err != nil {
+		log.Printf("tracing: exporting %d spans: %v", len(batch), err)
+	}
+}
+
+// post sends spans to an OTLP/HTTP endpoint with the JSON encoding.
+func (tracer *Tracer) post(client *http.Client, data []byte) error {
+	request, err := http.NewRequest(http.MethodPost, tracer.config.Endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range tracer.config.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%v: %v", tracer.config.Endpoint, response.Status)
+	}
+	return nil
+}
+
+/**
+ * Span is a traced operation. It is exported when it ends.
+ *
+ * All methods accept a nil span, which is what a nil Tracer starts, so call sites don't check whether
+ * tracing is enabled.
+ */
+type Span struct {
+	tracer  *Tracer
+	Context TraceContext
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	mutex   sync.Mutex
+	attrs   []otlpAttribute
+	links   []otlpLink
+	status  otlpStatus
+	ended   bool
+}
+
+// Child starts a span under this one.
+func (span *Span) Child(name string, kind int, start time.Time) *Span {
+	if span == nil {
+		return nil
+	}
+	return span.tracer.Start(name, kind, &span.Context, start)
+}
+
+func (span *Span) SetName(name string) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.name = name
+}
+
+// SetAttribute sets a string, integer or boolean attribute.
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.attrs = append(span.attrs, newAttribute(key, value))
+}
+
+// AddLink relates the span to a span of another trace.
+func (span *Span) AddLink(context TraceContext) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.links = append(span.links, otlpLink{
+		TraceID: hex.EncodeToString(context.TraceID[:]),
+		SpanID:  hex.EncodeToString(context.SpanID[:]),
+	})
+}
+
+// SetError marks the span as failed.
+func (span *Span) SetError(message string) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.status = otlpStatus{Code: spanStatusError, Message: message}
+}
+
+func (span *Span) End() {
+	span.EndAt(time.Now())
+}
+
+// EndAt ends the span at a time it was measured at, and queues it for export. Only the first call counts.
+func (span *Span) EndAt(end time.Time) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	if span.ended {
+		span.mutex.Unlock()
+		return
+	}
+	span.ended = true
+	exported := otlpSpan{
+		TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        span.attrs,
+		Links:             span.links,
+		Status:            span.status,
+	}
+	if span.parent != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(span.parent[:])
+	}
+	span.mutex.Unlock()
+	select {
+	case span.tracer.spans <- exported:
+	default:
+		span.tracer.dropped.Add(1)
+	}
+}
+
+// spanTiming is an operation timed before the span it belongs under was started.
+type spanTiming struct {
+	start time.Time
+	end   time.Time
+	err   error
+}
+
+/**
+ * QueryCycle is a query cycle of a session: the frontend messages up to a Query, FunctionCall or Sync,
+ * and the backend's answers up to ReadyForQuery.
+ */
+type QueryCycle struct {
+	// When the first frontend message of the cycle was received
+	Start time.Time
+	// When the first message of the cycle was sent to the backend
+	Sent time.Time
+	// When the backend's ReadyForQuery was received
+	Received  time.Time
+	Statement string
+	// Tag of the last CommandComplete without the row count, e.g. INSERT
+	Command string
+	// Rows of the CommandComplete tags
+	Rows     int64
+	SQLState string
+	// Trace context found in a query comment
+	parent *TraceContext
+}
+
+/**
+ * QueryCycles follows the query cycles of a session for metrics and tracing.
+ *
+ * Like TransactionState it pairs Query, FunctionCall and Sync messages with ReadyForQuery, so pipelined
+ * cycles are each timed from their first message. Named prepared statements are remembered to know the
+ * statement of a Bind.
+ */
+type QueryCycles struct {
+	mutex sync.Mutex
+	// Cycles waiting for their ReadyForQuery
+	pending []*QueryCycle
+	// Extended query cycle not closed by a Sync yet
+	open *QueryCycle
+	// Cycle of the last frontend message
+	last       *QueryCycle
+	statements map[string]string
+}
+
+func NewQueryCycles() *QueryCycles {
+	return &QueryCycles{statements: make(map[string]string)}
+}
+
+// Frontend records a message received from the frontend, before it is sent to a backend.
+func (cycles *QueryCycles) Frontend(msg []byte) {
+	cycles.mutex.Lock()
+	defer cycles.mutex.Unlock()
+	switch GetMessageType(msg) {
+	case MessageTypeQuery:
+		cycle := &QueryCycle{Start: time.Now(), Statement: GetQuery(msg)}
+		cycle.parent = FindQueryTraceparent(cycle.Statement)
+		cycles.pending = append(cycles.pending, cycle)
+		cycles.last = cycle
+	case MessageTypeFunctionCall:
+		cycle := &QueryCycle{Start: time.Now()}
+		cycles.pending = append(cycles.pending, cycle)
+		cycles.last = cycle
+	case MessageTypeSync:
+		cycle := cycles.extended()
+		cycles.pending = append(cycles.pending, cycle)
+		cycles.open = nil
+		cycles.last = cycle
+	case MessageTypeParse, MessageTypeBind, MessageTypeDescribe, MessageTypeExecute, MessageTypeClose, MessageTypeFlush:
+		cycle := cycles.extended()
+		cycles.last = cycle
+		cycles.statement(cycle, msg)
+	}
+}
+
+func (cycles *QueryCycles) extended() *QueryCycle {
+	if cycles.open == nil {
+		cycles.open = &QueryCycle{Start: time.Now()}
+	}
+	return cycles.open
+}
+
+// statement follows the statement an extended query cycle runs.
+func (cycles *QueryCycles) statement(cycle *QueryCycle, msg []byte) {
+	switch GetMessageType(msg) {
+	case MessageTypeParse:
+		name, query, _, err := GetParseMessage(msg)
+		if err != nil {
+			return
+		}
+		if name != "" {
+			cycles.statements[name] = query
+		}
+		cycle.Statement = query
+		if parent := FindQueryTraceparent(query); parent != nil {
+			cycle.parent = parent
+		}
+	case MessageTypeBind:
+		_, name, _, err := GetBindMessage(msg)
+		if err == nil && name != "" {
+			if query, ok := cycles.statements[name]; ok {
+				cycle.Statement = query
+				if parent := FindQueryTraceparent(query); parent != nil {
+					cycle.parent = parent
+				}
+			}
+		}
+	case MessageTypeClose:
+		if target, name, err := GetTarget(msg); err == nil && target == 'S' {
+			delete(cycles.statements, name)
+		}
+	}
+}
+
+// Sent records that the last frontend message was sent to the backend.
+func (cycles *QueryCycles) Sent() {
+	cycles.mutex.Lock()
+	defer cycles.mutex.Unlock()
+	if cycles.last != nil && cycles.last.Sent.IsZero() {
+		cycles.last.Sent = time.Now()
+	}
+}
+
+// Backend records a message received from the backend and returns the cycle a ReadyForQuery completes.
+func (cycles *QueryCycles) Backend(msg []byte) *QueryCycle {
+	cycles.mutex.Lock()
+	defer cycles.mutex.Unlock()
+	if len(cycles.pending) == 0 {
+		return nil
+	}
+	cycle := cycles.pending[0]
+	switch GetMessageType(msg) {
+	case MessageTypeCommandComplete:
+		if tag, err := GetCommandTag(msg); err == nil {
+			cycle.Command = CommandTagName(tag)
+			cycle.Rows += CommandTagRows(tag)
+		}
+	case MessageTypeErrorResponse:
+		cycle.SQLState = GetErrorResponse(msg).Code
+	case MessageTypeReadyForQuery:
+		cycles.pending = cycles.pending[1:]
+		cycle.Received = time.Now()
+		return cycle
+	}
+	return nil
+}
+
+// traceQuery exports the spans of a query cycle that the frontend has been answered for.
+func (proxy *PostgresProxy) traceQuery(cycle *QueryCycle, pg *PGConnection) {
+	if proxy.span == nil {
+		return
+	}
+	end := time.Now()
+	name := cycle.Command
+	if name == "" {
+		name = "query"
+	}
+	parent := &proxy.span.Context
+	if cycle.parent != nil {
+		parent = cycle.parent
+	}
+	span := proxy.Tracer.Start(name, SpanKindServer, parent, cycle.Start)
+	if cycle.parent != nil {
+		span.AddLink(proxy.span.Context)
+	}
+	statement := cycle.Statement
+	if proxy.Config.Tracing.NormalizeStatements {
+		statement = NormalizeQuery(statement)
+	}
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.name", pg.database)
+	span.SetAttribute("db.user", pg.username)
+	span.SetAttribute("pgproxy.backend", pg.pool.Key.Backend)
+	if statement != "" {
+		span.SetAttribute("db.statement", statement)
+	}
+	if cycle.Command != "" {
+		span.SetAttribute("db.operation", cycle.Command)
+		span.SetAttribute("db.response.returned_rows", cycle.Rows)
+	}
+	if cycle.SQLState != "" {
+		span.SetAttribute("db.response.status_code", cycle.SQLState)
+		span.SetError("SQLSTATE " + cycle.SQLState)
+	}
+	if !cycle.Sent.IsZero() {
+		backend := span.Child("backend query", SpanKindClient, cycle.Sent)
+		backend.SetAttribute("db.system", "postgresql")
+		backend.SetAttribute("server.address", pg.backend.Address)
+		if cycle.SQLState != "" {
+			backend.SetError("SQLSTATE " + cycle.SQLState)
+		}
+		backend.EndAt(cycle.Received)
+	}
+	span.EndAt(end)
+}
+
+/**
+ * NormalizeQuery replaces the literals of a query with $? and drops its comments, so db.statement doesn't
+ * carry values. Quoted identifiers are kept. A query that can't be lexed is replaced by "?".
+ */
+func NormalizeQuery(query string) string {
+	var normalized strings.Builder
+	space := false
+	write := func(s string) {
+		if space && normalized.Len() > 0 {
+			normalized.WriteByte(' ')
+		}
+		space = false
+		normalized.WriteString(s)
+	}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			i++
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 1
+			}
+			space = true
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			depth := 0
+			for i < len(query) {
+				if strings.HasPrefix(query[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(query[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			if depth != 0 {
+				return "?"
+			}
+			space = true
+		case c == '\'':
+			end := skipQuoted(query, i, c, i > 0 && (query[i-1] == 'E' || query[i-1] == 'e'))
+			if end < 0 {
+				return "?"
+			}
+			write("$?")
+			i = end
+		case c == '"':
+			end := skipQuoted(query, i, c, false)
+			if end < 0 {
+				return "?"
+			}
+			write(query[i:end])
+			i = end
+		case c == '$':
+			end := skipDollarQuoted(query, i)
+			if end < 0 {
+				return "?"
+			}
+			if end == i+1 {
+				// A $1 parameter, its number follows as a word
+				for end < len(query) && query[end] >= '0' && query[end] <= '9' {
+					end++
+				}
+				write(query[i:end])
+			} else {
+				write("$?")
+			}
+			i = end
+		case isWordByte(c):
+			start := i
+			for i < len(query) && (isWordByte(query[i]) || query[i] == '$' || (query[i] == '.' && c >= '0' && c <= '9')) {
+				i++
+			}
+			word := query[start:i]
+			switch {
+			case c >= '0' && c <= '9':
+				write("$?")
+			case i < len(query) && query[i] == '\'' && len(word) == 1 && strings.ContainsAny(word, "EeBbXxNn"):
+				// The prefix of E'', B'', X'' and N'' literals
+			default:
+				write(word)
+			}
+		default:
+			write(query[i : i+1])
+			i++
+		}
+	}
+	return normalized.String()
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue, 64 bit integers are strings in OTLP/JSON.
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func newAttribute(key string, value interface{}) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		attribute.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		attribute.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attribute.Value.IntValue = &s
+	case bool:
+		attribute.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attribute.Value.StringValue = &s
+	}
+	return attribute
+}
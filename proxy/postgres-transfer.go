@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+ * Message-level transfer between frontend and backend.
+ *
+ * Messages are relayed one at a time so the proxy knows where the session is in the protocol:
+ * the frontend's Terminate is not forwarded, and the backend connection can only go back to the pool
+ * when it is idle between transactions.
+ *
+ * In session mode the backend connection stays attached until the frontend terminates.
+ * In transaction mode it is attached when the frontend sends a message and detached again at
+ * ReadyForQuery 'I' once every query cycle has completed, so idle frontends hold no backend.
+ */
+
+// TransactionState follows query cycles to know whether the backend is idle.
+type TransactionState struct {
+	mutex sync.Mutex
+	// Messages sent by the frontend that the backend answers with ReadyForQuery (Query, Sync, FunctionCall)
+	syncs int
+	// ReadyForQuery messages received from the backend
+	readys int
+	// Extended query messages sent since the last Sync
+	extended bool
+	status   byte
+}
+
+func NewTransactionState() *TransactionState {
+	return &TransactionState{status: TransactionStatusIdle}
+}
+
+func (state *TransactionState) Frontend(msg []byte) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	switch GetMessageType(msg) {
+	case MessageTypeQuery, MessageTypeFunctionCall:
+		state.syncs++
+	case MessageTypeSync:
+		state.syncs++
+		state.extended = false
+	case MessageTypeParse, MessageTypeBind, MessageTypeDescribe, MessageTypeExecute, MessageTypeClose, MessageTypeFlush:
+		state.extended = true
+	}
+}
+
+func (state *TransactionState) Backend(msg []byte) error {
+	if GetMessageType(msg) != MessageTypeReadyForQuery {
+		return nil
+	}
+	status, err := GetTransactionStatus(msg)
+	if err != nil {
+		return err
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.readys++
+	state.status = status
+	return nil
+}
+
+// Idle reports whether every query cycle has completed outside of a transaction block.
+func (state *TransactionState) Idle() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.syncs == state.readys && !state.extended && state.status == TransactionStatusIdle
+}
+
+// Status returns the transaction status of the last ReadyForQuery.
+func (state *TransactionState) Status() byte {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.status
+}
+
+// Activity describes the session as the state column of pg_stat_activity does.
+func (state *TransactionState) Activity() string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	switch {
+	case state.syncs != state.readys || state.extended:
+		return "active"
+	case state.status == TransactionStatusInTransaction:
+		return "idle in transaction"
+	case state.status == TransactionStatusFailed:
+		return "idle in transaction (aborted)"
+	}
+	return "idle"
+}
+
+/**
+ * transfer relays messages until the frontend terminates or either side fails.
+ *
+ * When it returns, the backend connection (if still attached) has been released to the pool.
+ */
+func (proxy *PostgresProxy) transfer() {
+	proxy.pmutex.Lock()
+	proxy.state = NewTransactionState()
+	proxy.queries = NewQueryCycles()
+	draining := proxy.draining
+	proxy.pmutex.Unlock()
+	if draining {
+		proxy.Terminate(adminShutdownMessage)
+		return
+	}
+	if proxy.pool.Mode() == PoolModeTransaction {
+		proxy.statements = NewStatementTracker()
+	}
+	proxy.startSplit()
+
+	go proxy.channelRecorder.Watch()
+
+	proxy.pmutex.Lock()
+	if pg := proxy.ForwardConnection; pg != nil {
+		if proxy.pool.Mode() == PoolModeTransaction {
+			// The connection was only needed for the startup handshake
+			proxy.ForwardConnection = nil
+			pg.pool.Release(pg, true)
+		} else {
+			proxy.startBackendRelay(pg)
+		}
+	}
+	proxy.pmutex.Unlock()
+
+	if packet := proxy.relayFrontend(); packet.Error != nil {
+		log.Println(packet.Error)
+	}
+
+	proxy.pmutex.Lock()
+	pg, done := proxy.ForwardConnection, proxy.backendDone
+	proxy.ForwardConnection, proxy.backendDone = nil, nil
+	proxy.pmutex.Unlock()
+	if pg == nil {
+		return
+	}
+	// Stop reading from the backend without closing it
+	_ = pg.Conn.SetReadDeadline(time.Now())
+	packet := <-done
+	_ = pg.Conn.SetReadDeadline(time.Time{})
+	stopped := errors.Is(packet.Error, os.ErrDeadlineExceeded) && packet.Length == 0
+	pg.pool.Release(pg, stopped && proxy.state.Idle())
+}
+
+/**
+ * relayFrontend forwards frontend messages to the attached backend until the frontend terminates.
+ *
+ * With read/write splitting, extended query messages are held back in a splitBatch until the query cycle
+ * is known to be read-only or not.
+ */
+func (proxy *PostgresProxy) relayFrontend() Packet {
+	var batch *splitBatch
+	for {
+		packet := proxy.ReverseConnection.ReadMessage()
+		if packet.Error != nil {
+			return packet
+		}
+		switch GetMessageType(packet.Body) {
+		case MessageTypeTerminate:
+			return Packet{}
+		case MessageTypeQuery:
+			proxy.connection.Query(GetQuery(packet.Body))
+		case MessageTypeParse:
+			if _, query, _, err := GetParseMessage(packet.Body); err == nil {
+				proxy.connection.Query(query)
+			}
+		}
+		proxy.queries.Frontend(packet.Body)
+		messages, readOnly := [][]byte{packet.Body}, false
+		if proxy.split != nil {
+			if batch == nil && isExtendedRequest(GetMessageType(packet.Body)) {
+				batch = &splitBatch{parsed: make(map[string]bool)}
+			}
+			if batch == nil {
+				readOnly = proxy.readOnly(packet.Body)
+			} else {
+				if batch.Add(proxy, packet.Body) {
+					continue
+				}
+				messages, readOnly = batch.messages, batch.ReadOnly()
+				batch = nil
+			}
+		}
+		for _, msg := range messages {
+			if packet := proxy.relayFrontendMessage(msg, readOnly); packet.Error != nil {
+				return packet
+			}
+		}
+	}
+}
+
+// relayFrontendMessage sends a frontend message to the attached backend, attaching one when needed.
+func (proxy *PostgresProxy) relayFrontendMessage(msg []byte, readOnly bool) Packet {
+	pg, err := proxy.attach(msg, readOnly)
+	if err != nil {
+		return Packet{Error: err}
+	}
+	messages := [][]byte{msg}
+	if proxy.statements != nil {
+		if messages, err = proxy.statements.Frontend(pg, proxy.ReverseConnection, msg); err != nil {
+			return Packet{Error: err}
+		}
+	}
+	for _, message := range messages {
+		if sent := pg.SendMessage(message); sent.Error != nil {
+			return sent
+		}
+		pg.pool.metrics.Frontend(message)
+	}
+	proxy.queries.Sent()
+	_, _ = proxy.channelRecorder.Write(msg)
+	return Packet{}
+}
+
+/**
+ * attach returns the backend connection for a frontend message, acquiring one from the pool when none is attached.
+ * While the pools are paused the session waits without holding its lock, so the admin console can still see it.
+ *
+ * The message is recorded in the transaction state before the lock is released,
+ * so the backend relay can't detach the connection while the message is on its way.
+ */
+func (proxy *PostgresProxy) attach(msg []byte, readOnly bool) (*PGConnection, error) {
+	proxy.pmutex.Lock()
+	defer proxy.pmutex.Unlock()
+	for proxy.ForwardConnection == nil {
+		resumed := proxy.Pools.Resumed()
+		if resumed == nil {
+			break
+		}
+		proxy.pmutex.Unlock()
+		<-resumed
+		proxy.pmutex.Lock()
+	}
+	if proxy.ForwardConnection == nil {
+		route, err := proxy.Router.Follow(proxy.Route)
+		if err != nil {
+			_ = proxy.ReverseConnection.sendErrorResponse(ErrorSeverityFatal, SQLStateConnectionFailure, err.Error())
+			return nil, err
+		}
+		if route != proxy.Route {
+			// The cluster failed over since the last transaction
+			pool, err := proxy.Pools.Join(route)
+			if err != nil {
+				proxy.sendPoolError(err)
+				return nil, err
+			}
+			log.Printf("moving %v to backend %v", proxy.ReverseConnection.Conn.RemoteAddr(), route.BackendName)
+			proxy.pool.Leave()
+			proxy.Route, proxy.pool = route, pool
+		}
+		pg, err := proxy.splitPool(readOnly).Acquire(proxy.poolRequest())
+		if err != nil {
+			proxy.sendPoolError(err)
+			return nil, err
+		}
+		proxy.session.Apply(pg)
+		proxy.ForwardConnection = pg
+		if proxy.statements != nil {
+			proxy.statements.Reset()
+		}
+		proxy.startBackendRelay(pg)
+	}
+	proxy.state.Frontend(msg)
+	return proxy.ForwardConnection, nil
+}
+
+func (proxy *PostgresProxy) startBackendRelay(pg *PGConnection) {
+	done := make(chan Packet, 1)
+	proxy.backendDone = done
+	go func() {
+		done <- proxy.relayBackend(pg)
+	}()
+}
+
+/**
+ * relayBackend forwards backend messages to the frontend.
+ *
+ * In transaction mode, or when the session is drained, it detaches the backend at the end of a transaction
+ * and returns it to the pool.
+ * If the backend fails, the frontend connection is closed so the session ends.
+ */
+func (proxy *PostgresProxy) relayBackend(pg *PGConnection) Packet {
+	for {
+		packet := pg.ReadMessage()
+		if packet.Error != nil {
+			if !errors.Is(packet.Error, os.ErrDeadlineExceeded) {
+				log.Println(packet.Error)
+				_ = proxy.ReverseConnection.Close()
+			}
+			return packet
+		}
+		if GetMessageType(packet.Body) == MessageTypeParameterStatus {
+			// Follow the frontend's SET commands
+			pg.recordParameterStatus(packet.Body)
+			if name, value, err := GetParameterStatus(packet.Body); err == nil {
+				proxy.session.Update(name, value)
+			}
+		}
+		cycle := proxy.queries.Backend(packet.Body)
+		var err error
+		if proxy.statements != nil {
+			err = proxy.statements.Backend(pg, proxy.ReverseConnection, packet.Body)
+		} else {
+			err = proxy.ReverseConnection.SendMessage(packet.Body).Error
+		}
+		if err != nil {
+			_ = proxy.ReverseConnection.Close()
+			return Packet{Length: packet.Length, Error: err}
+		}
+		_, _ = proxy.channelRecorder.Write(packet.Body)
+		pg.pool.metrics.Backend(packet.Body)
+		if cycle != nil {
+			pg.pool.metrics.QueryDuration.ObserveDuration(cycle.Received.Sub(cycle.Start))
+			proxy.traceQuery(cycle, pg)
+		}
+
+		if err := proxy.state.Backend(packet.Body); err != nil {
+			log.Println(err)
+			_ = proxy.ReverseConnection.Close()
+			return Packet{Length: packet.Length, Error: err}
+		}
+		if GetMessageType(packet.Body) != MessageTypeReadyForQuery {
+			continue
+		}
+		// Sessions being drained end here, as if in transaction mode
+		draining := proxy.Draining()
+		if !draining && proxy.pool.Mode() != PoolModeTransaction {
+			continue
+		}
+		proxy.pmutex.Lock()
+		detach := proxy.ForwardConnection == pg && proxy.state.Idle()
+		if detach {
+			proxy.ForwardConnection, proxy.backendDone = nil, nil
+		}
+		proxy.pmutex.Unlock()
+		if detach {
+			if proxy.split != nil {
+				proxy.split.Detach()
+			}
+			pg.pool.Release(pg, true)
+			if draining {
+				proxy.Terminate(adminShutdownMessage)
+			}
+			return Packet{}
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Listener handoff needs Unix sockets, see postgres-upgrade.go.
+
+func InheritListeners(path string) ([]net.Listener, func() error, error) {
+	return nil, nil, nil
+}
+
+func ServeUpgrades(path string, listeners []net.Listener, handedOff chan<- struct{}) error {
+	return errors.New("listener handoff is not supported on this platform")
+}
+
+func WatchUpgradeSignal(path string) {}
@@ -0,0 +1,211 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+/**
+ * Binary upgrades
+ *
+ * A running proxy hands its listening sockets to a new proxy process over the upgrade_socket Unix socket,
+ * so no connection is refused while the binary is replaced:
+ *
+ *   1. the new process connects to upgrade_socket and receives the listeners' file descriptors (SCM_RIGHTS):
+ *      the PostgreSQL listener, then the HTTP listener when there is one
+ *   2. it starts accepting on the listeners, and answers 'R' (ready)
+ *   3. the old process stops accepting and drains its sessions as on SIGTERM, then exits
+ *
+ * If the new process fails before it is ready, the old process keeps serving. Upgrades are started by
+ * running the new binary with the same configuration, or by sending the running proxy SIGUSR2, which
+ * starts its executable again with the same arguments.
+ *
+ * The old process must not be PID 1, as it is in a container started without an init: when it exits after
+ * the handoff, the kernel kills every other process of its PID namespace, the new proxy included. Upgrades
+ * are disabled there, and need a supervisor that outlives the proxy process.
+ */
+
+var errUpgradeAsInit = errors.New("upgrades are disabled when the proxy runs as PID 1, run it under a supervisor")
+
+const (
+	upgradeReady        byte = 'R'
+	upgradeReadyTimeout      = 30 * time.Second
+	// Listeners handed over at most: PostgreSQL and HTTP
+	upgradeMaxListeners = 2
+)
+
+/**
+ * InheritListeners takes over the listeners of the proxy serving the upgrade socket.
+ *
+ * It returns no listeners when no proxy is running. Otherwise ready must be called once the listeners are served.
+ */
+func InheritListeners(path string) (listeners []net.Listener, ready func() error, err error) {
+	if path == "" {
+		return nil, nil, nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		// No running proxy
+		return nil, nil, nil
+	}
+	unix := conn.(*net.UnixConn)
+	defer func() {
+		if err != nil {
+			_ = unix.Close()
+		}
+	}()
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4*upgradeMaxListeners))
+	_, oobn, _, _, err := unix.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("upgrade: %w", err)
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) != 1 {
+		return nil, nil, fmt.Errorf("upgrade: no listener received from %v", path)
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) == 0 {
+		return nil, nil, fmt.Errorf("upgrade: no listener received from %v", path)
+	}
+	for _, fd := range fds {
+		file := os.NewFile(uintptr(fd), "listener")
+		listener, ferr := net.FileListener(file)
+		_ = file.Close()
+		if ferr != nil && err == nil {
+			err = fmt.Errorf("upgrade: %w", ferr)
+		}
+		if listener != nil {
+			listeners = append(listeners, listener)
+		}
+	}
+	if err != nil {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+		return nil, nil, err
+	}
+	ready = func() error {
+		defer func() {
+			_ = unix.Close()
+		}()
+		_, err := unix.Write([]byte{upgradeReady})
+		return err
+	}
+	return listeners, ready, nil
+}
+
+/**
+ * ServeUpgrades hands the listeners to the first new process that connects to the upgrade socket
+ * and becomes ready, then closes handedOff.
+ */
+func ServeUpgrades(path string, listeners []net.Listener, handedOff chan<- struct{}) error {
+	if os.Getpid() == 1 {
+		log.Printf("upgrade: %v", errUpgradeAsInit)
+		return nil
+	}
+	// The socket is left behind by the previous process, which no longer uses it
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	upgrades, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// The next process binds the same path before this one closes its socket
+	upgrades.SetUnlinkOnClose(false)
+	go func() {
+		defer func() {
+			_ = upgrades.Close()
+		}()
+		for {
+			conn, err := upgrades.AcceptUnix()
+			if err != nil {
+				log.Printf("upgrade: %v", err)
+				return
+			}
+			err = handoff(conn, listeners)
+			_ = conn.Close()
+			if err != nil {
+				log.Printf("upgrade: new process failed, still serving: %v", err)
+				continue
+			}
+			log.Printf("upgrade: listeners handed over to the new process")
+			close(handedOff)
+			return
+		}
+	}()
+	return nil
+}
+
+func handoff(conn *net.UnixConn, listeners []net.Listener) error {
+	fds := make([]int, 0, len(listeners))
+	for _, listener := range listeners {
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("can't hand over a %T", listener)
+		}
+		file, err := tcp.File()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		fds = append(fds, int(file.Fd()))
+	}
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(upgradeReadyTimeout)); err != nil {
+		return err
+	}
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		return err
+	}
+	if buf[0] != upgradeReady {
+		return fmt.Errorf("unexpected answer %q", buf[0])
+	}
+	return nil
+}
+
+// WatchUpgradeSignal starts a new proxy process from the executable on SIGUSR2.
+func WatchUpgradeSignal(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	for range signals {
+		if path == "" {
+			log.Printf("upgrade: upgrade_socket is not configured")
+			continue
+		}
+		if os.Getpid() == 1 {
+			log.Printf("upgrade: %v", errUpgradeAsInit)
+			continue
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			log.Printf("upgrade: %v", err)
+			continue
+		}
+		cmd := exec.Command(executable, os.Args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			log.Printf("upgrade: %v", err)
+			continue
+		}
+		log.Printf("upgrade: started %v (pid %d)", executable, cmd.Process.Pid)
+		go func() {
+			_ = cmd.Wait()
+		}()
+	}
+}
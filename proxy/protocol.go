@@ -3,6 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
 )
 
 /**
@@ -24,19 +28,56 @@ const (
 	 * The least significant 16 bits are the minor version number (0 for the protocol described here).
 	 */
 	ProtocolVersion int32 = 196608
+	/**
+	 * Protocol version 3.2 (PostgreSQL 18), whose BackendKeyData and CancelRequest carry secret keys of up to
+	 * MaxCancelKeyLength bytes instead of an int32.
+	 */
+	ProtocolVersion32 int32 = 196610
+	// The newest protocol version the proxy speaks
+	ProtocolVersionLatest = ProtocolVersion32
+	MaxCancelKeyLength    = 256
 	/**
 	 * The SSL request code.
 	 * The value is chosen to contain 1234 in the most significant 16 bits, and 5679 in the least significant 16 bits.
 	 */
 	SSLRequestCode int32 = 80877103
+	/**
+	 * The GSSAPI encryption request code.
+	 * The value is chosen to contain 1234 in the most significant 16 bits, and 5680 in the least significant 16 bits.
+	 */
+	GSSENCRequestCode int32 = 80877104
+	/**
+	 * The cancel request code.
+	 * The value is chosen to contain 1234 in the most significant 16 bits, and 5678 in the least significant 16 bits.
+	 */
+	CancelRequestCode int32 = 80877102
+	// Prefix of protocol options in the startup message, as opposed to run-time parameters
+	ProtocolOptionPrefix = "_pq_."
 )
 
+// ProtocolMajorVersion and ProtocolMinorVersion split a protocol version number.
+func ProtocolMajorVersion(version int32) int32 {
+	return version >> 16
+}
+
+func ProtocolMinorVersion(version int32) int32 {
+	return version & 0xffff
+}
+
 /* SSL Responses */
 const (
 	SSLAllowed    byte = 'S'
 	SSLNotAllowed byte = 'N'
 )
 
+/* Direct SSL negotiation (PostgreSQL 17) */
+const (
+	// First byte of a TLS ClientHello, a TLS handshake record
+	TLSHandshakeRecordType byte = 0x16
+	// ALPN protocol of PostgreSQL, required with direct negotiation
+	ALPNProtocolPostgreSQL = "postgresql"
+)
+
 const (
 	//Identifies the message as an authentication request (B)
 	MessageTypeAuthentication byte = 'R'
@@ -44,6 +85,8 @@ const (
 	MessageTypePasswordResponse byte = 'p'
 	//Identifies the message as a run-time parameter status report (B)
 	MessageTypeParameterStatus byte = 'S'
+	//Identifies the message as a protocol version negotiation (B)
+	MessageTypeNegotiateProtocolVersion byte = 'v'
 	//Identifies the message as cancellation key data (B)
 	MessageTypeBackendKeyData byte = 'K'
 	//Identifies the message type ReadyForQuery which is sent whenever the backend is ready for a new query cycle (B)
@@ -52,8 +95,123 @@ const (
 	MessageTypeTerminate byte = 'X'
 	//Identifies the message as a simple query (F)
 	MessageTypeQuery byte = 'Q'
+	//Identifies the message as an error (B)
+	MessageTypeErrorResponse byte = 'E'
+	//Identifies the message as a notice (B)
+	MessageTypeNoticeResponse byte = 'N'
+	//Identifies the message as a row description (B)
+	MessageTypeRowDescription byte = 'T'
+	//Identifies the message as a data row (B)
+	MessageTypeDataRow byte = 'D'
+	//Identifies the message as a command-completed response (B)
+	MessageTypeCommandComplete byte = 'C'
+	//Identifies the message as a Parse command (F)
+	MessageTypeParse byte = 'P'
+	//Identifies the message as a Bind command (F)
+	MessageTypeBind byte = 'B'
+	//Identifies the message as a Describe command (F)
+	MessageTypeDescribe byte = 'D'
+	//Identifies the message as an Execute command (F)
+	MessageTypeExecute byte = 'E'
+	//Identifies the message as a Close command (F)
+	MessageTypeClose byte = 'C'
+	//Identifies the message as a Flush command (F)
+	MessageTypeFlush byte = 'H'
+	//Identifies the message as a Sync command (F)
+	MessageTypeSync byte = 'S'
+	//Identifies the message as a function call (F)
+	MessageTypeFunctionCall byte = 'F'
+	//Identifies the message as a Parse-complete indicator (B)
+	MessageTypeParseComplete byte = '1'
+	//Identifies the message as a Bind-complete indicator (B)
+	MessageTypeBindComplete byte = '2'
+	//Identifies the message as a Close-complete indicator (B)
+	MessageTypeCloseComplete byte = '3'
+	//Identifies the message as a parameter description (B)
+	MessageTypeParameterDescription byte = 't'
+	//Identifies the message as a no-data indicator (B)
+	MessageTypeNoData byte = 'n'
+	//Identifies the message as a response to an empty query string (B)
+	MessageTypeEmptyQueryResponse byte = 'I'
+	//Identifies the message as a portal-suspended indicator (B)
+	MessageTypePortalSuspended byte = 's'
+	//Identifies the message as a notification response (B)
+	MessageTypeNotificationResponse byte = 'A'
+)
+
+/** Describe and Close targets */
+const (
+	TargetPreparedStatement byte = 'S'
+	TargetPortal            byte = 'P'
+)
+
+// Upper bound for a single message accepted by the proxy (the server's own limit is 1GB)
+const MaxMessageLength int = 1 << 30
+
+// Upper bound for authentication messages, read before the client is authenticated (PG_MAX_AUTH_TOKEN_LENGTH)
+const MaxAuthMessageLength int = 65535
+
+// Messages up to this length are read into a buffer of their announced length at once
+const MessageBufferSize int = 64 << 10
+
+// Upper bound for a startup packet, as the server's MAX_STARTUP_PACKET_LENGTH
+const MaxStartupMessageLength int = 10000
+
+/** Error and Notice message fields */
+const (
+	//Severity: the field contents are ERROR, FATAL, or PANIC (in an error message), or WARNING, NOTICE, DEBUG, INFO, or LOG (in a notice message)
+	ErrorFieldSeverity byte = 'S'
+	//Severity: identical to the S field except that the contents are never localized
+	ErrorFieldSeverityNonLocalized byte = 'V'
+	//Code: the SQLSTATE code for the error
+	ErrorFieldCode byte = 'C'
+	//Message: the primary human-readable error message
+	ErrorFieldMessage byte = 'M'
+)
+
+// PostgresError is an ErrorResponse received from a backend.
+type PostgresError struct {
+	Severity string
+	Code     string
+	Message  string
+}
+
+func (e *PostgresError) Error() string {
+	return fmt.Sprintf("%v: %v (SQLSTATE %v)", e.Severity, e.Message, e.Code)
+}
+
+/** Error and notice severities */
+const (
+	ErrorSeverityError   = "ERROR"
+	ErrorSeverityFatal   = "FATAL"
+	NoticeSeverityNotice = "NOTICE"
 )
 
+/**
+ * PostgreSQL Error Codes
+ *
+ * https://www.postgresql.org/docs/current/errcodes-appendix.html
+ */
+const (
+	SQLStateInvalidCatalogName   = "3D000"
+	SQLStateTooManyConnections   = "53300"
+	SQLStateConnectionFailure    = "08006"
+	SQLStateProtocolViolation    = "08P01"
+	SQLStateInvalidAuthorization = "28000"
+	SQLStateInvalidPassword      = "28P01"
+	SQLStateFeatureNotSupported  = "0A000"
+	SQLStateAdminShutdown        = "57P01"
+	SQLStateSyntaxError          = "42601"
+	SQLStateUndefinedObject      = "42704"
+	SQLStateDuplicatePrepared    = "42P05"
+	SQLStateNotInPrerequisite    = "55000"
+	SQLStateConfigFileError      = "F0000"
+	SQLStateSuccessfulCompletion = "00000"
+)
+
+// Type OID of text, the type of every column the proxy answers itself
+const TypeOIDText int32 = 25
+
 /** Current backend transaction status indicator */
 const (
 	//Idle (not in a transaction block)
@@ -115,6 +273,8 @@ const (
 	ConnectionAttributeApplicationName = "application_name"
 	ConnectionAttributeUser            = "user"
 	ConnectionAttributeDatabase        = "database"
+	// Proxy option in the startup message, consumed by the proxy
+	ConnectionAttributeReadWriteSplit = "pgproxy.read_write_split"
 )
 
 func GetStartupMessageAttributes(msg []byte) (m map[string]string) {
@@ -127,17 +287,17 @@ func GetStartupMessageAttributes(msg []byte) (m map[string]string) {
 	if _, err := buf.Read(bs); err != nil { //Message opcode
 		return
 	}
-	// Startup attributes (if any)
+	// Startup attributes (if any), terminated by an empty key
 	for {
 		key, err := buf.ReadString(0x00)
-		if err != nil || len(key) == 0 {
+		if err != nil || len(key) <= 1 {
 			return
 		}
 		value, err := buf.ReadString(0x00)
-		if err != nil || len(value) == 0 {
+		if err != nil {
 			return
 		}
-		m[key] = value
+		m[strings.TrimSuffix(key, "\000")] = strings.TrimSuffix(value, "\000")
 	}
 }
 
@@ -154,5 +314,217 @@ func GetPasswordFromPasswordMessage(msg []byte) (password string, err error) {
 	if err != nil {
 		return
 	}
+	return strings.TrimSuffix(password, "\x00"), nil
+}
+
+func GetMessageLength(message []byte) (_ int32, err error) {
+	var msgLength int32
+	reader := bytes.NewReader(message[1:5])
+	if err = binary.Read(reader, binary.BigEndian, &msgLength); err != nil {
+		return
+	}
+	return msgLength, nil
+}
+
+func GetParameterStatus(msg []byte) (name string, value string, err error) {
+	buf := bytes.NewBuffer(msg[5:])
+	if name, err = buf.ReadString(0x00); err != nil {
+		return
+	}
+	if value, err = buf.ReadString(0x00); err != nil {
+		return
+	}
+	return strings.TrimSuffix(name, "\000"), strings.TrimSuffix(value, "\000"), nil
+}
+
+// GetBackendKeyData reads the process ID and the secret key, 4 bytes in protocol 3.0 and up to 256 bytes in 3.2.
+func GetBackendKeyData(msg []byte) (processID int32, secretKey []byte, err error) {
+	if len(msg) < 13 || len(msg) > 9+MaxCancelKeyLength {
+		return 0, nil, fmt.Errorf("invalid BackendKeyData length %d", len(msg))
+	}
+	processID = int32(binary.BigEndian.Uint32(msg[5:9]))
+	return processID, append([]byte(nil), msg[9:]...), nil
+}
+
+// GetNegotiateProtocolVersion reads the newest minor version the server supports and the options it doesn't know.
+func GetNegotiateProtocolVersion(msg []byte) (minorVersion int32, options []string, err error) {
+	if len(msg) < 13 {
+		return 0, nil, fmt.Errorf("invalid NegotiateProtocolVersion length %d", len(msg))
+	}
+	minorVersion = int32(binary.BigEndian.Uint32(msg[5:9]))
+	count := int(binary.BigEndian.Uint32(msg[9:13]))
+	buf := bytes.NewBuffer(msg[13:])
+	for i := 0; i < count; i++ {
+		option, err := buf.ReadString(0x00)
+		if err != nil {
+			return 0, nil, err
+		}
+		options = append(options, strings.TrimSuffix(option, "\000"))
+	}
+	return minorVersion, options, nil
+}
+
+// GetCancelRequest reads the key of a CancelRequest, which has no message type byte.
+func GetCancelRequest(msg []byte) (processID int32, secretKey []byte, err error) {
+	if len(msg) < 16 || len(msg) > 12+MaxCancelKeyLength {
+		return 0, nil, fmt.Errorf("invalid cancel request length %d", len(msg))
+	}
+	processID = int32(binary.BigEndian.Uint32(msg[8:12]))
+	return processID, append([]byte(nil), msg[12:]...), nil
+}
+
+// GetQuery returns the query string of a Query message.
+func GetQuery(msg []byte) string {
+	if len(msg) < 6 {
+		return ""
+	}
+	return strings.TrimSuffix(string(msg[5:]), "\000")
+}
+
+// GetCommandTag reads the tag of a CommandComplete, e.g. "INSERT 0 1".
+func GetCommandTag(msg []byte) (string, error) {
+	tag, err := bytes.NewBuffer(msg[5:]).ReadString(0x00)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(tag, "\000"), nil
+}
+
+// CommandTagRows returns the row count of a command tag, 0 for commands without one.
+func CommandTagRows(tag string) int64 {
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0
+	}
+	rows, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return rows
+}
+
+// CommandTagName strips the row counts and OIDs from a command tag: "INSERT 0 1" is an INSERT.
+func CommandTagName(tag string) string {
+	fields := strings.Fields(tag)
+	for len(fields) > 1 {
+		if _, err := strconv.ParseUint(fields[len(fields)-1], 10, 64); err != nil {
+			break
+		}
+		fields = fields[:len(fields)-1]
+	}
+	return strings.Join(fields, " ")
+}
+
+// GetTransactionStatus returns the transaction status indicator of a ReadyForQuery message.
+func GetTransactionStatus(msg []byte) (byte, error) {
+	if len(msg) < 6 {
+		return 0, fmt.Errorf("invalid ReadyForQuery length %d", len(msg))
+	}
+	return msg[5], nil
+}
+
+func GetErrorResponse(msg []byte) *PostgresError {
+	e := &PostgresError{}
+	buf := bytes.NewBuffer(msg[5:])
+	for {
+		field, err := buf.ReadByte()
+		if err != nil || field == 0x00 {
+			return e
+		}
+		value, err := buf.ReadString(0x00)
+		if err != nil {
+			return e
+		}
+		value = strings.TrimSuffix(value, "\000")
+		switch field {
+		case ErrorFieldSeverityNonLocalized, ErrorFieldSeverity:
+			e.Severity = value
+		case ErrorFieldCode:
+			e.Code = value
+		case ErrorFieldMessage:
+			e.Message = value
+		}
+	}
+}
+
+// GetDataRowValues returns the column values of a DataRow, a nil entry is a NULL.
+func GetDataRowValues(msg []byte) (values [][]byte, err error) {
+	reader := bytes.NewReader(msg[5:])
+	var columns int16
+	if err = binary.Read(reader, binary.BigEndian, &columns); err != nil {
+		return
+	}
+	for i := 0; i < int(columns); i++ {
+		var length int32
+		if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if length < 0 {
+			values = append(values, nil)
+			continue
+		}
+		value := make([]byte, length)
+		if _, err = io.ReadFull(reader, value); err != nil {
+			return
+		}
+		values = append(values, value)
+	}
 	return
 }
+
+// GetParseMessage returns the statement name, query and parameter type OIDs of a Parse message.
+func GetParseMessage(msg []byte) (name string, query string, parameterOIDs []int32, err error) {
+	if len(msg) < 5 {
+		return "", "", nil, fmt.Errorf("invalid Parse length %d", len(msg))
+	}
+	buf := bytes.NewBuffer(msg[5:])
+	if name, err = buf.ReadString(0x00); err != nil {
+		return "", "", nil, fmt.Errorf("invalid Parse statement name: %w", err)
+	}
+	if query, err = buf.ReadString(0x00); err != nil {
+		return "", "", nil, fmt.Errorf("invalid Parse query: %w", err)
+	}
+	// The count is an unsigned 16-bit integer on the wire
+	var count uint16
+	if err = binary.Read(buf, binary.BigEndian, &count); err != nil {
+		return "", "", nil, fmt.Errorf("invalid Parse parameter count: %w", err)
+	}
+	if int(count)*4 != buf.Len() {
+		return "", "", nil, fmt.Errorf("invalid Parse message: %d parameter types in %d bytes", count, buf.Len())
+	}
+	parameterOIDs = make([]int32, count)
+	if err = binary.Read(buf, binary.BigEndian, parameterOIDs); err != nil {
+		return "", "", nil, err
+	}
+	return strings.TrimSuffix(name, "\000"), strings.TrimSuffix(query, "\000"), parameterOIDs, nil
+}
+
+// GetBindMessage returns the portal and statement names of a Bind message, and the remaining (parameter) bytes.
+func GetBindMessage(msg []byte) (portal string, statement string, parameters []byte, err error) {
+	if len(msg) < 5 {
+		return "", "", nil, fmt.Errorf("invalid Bind length %d", len(msg))
+	}
+	buf := bytes.NewBuffer(msg[5:])
+	if portal, err = buf.ReadString(0x00); err != nil {
+		return
+	}
+	if statement, err = buf.ReadString(0x00); err != nil {
+		return
+	}
+	return strings.TrimSuffix(portal, "\000"), strings.TrimSuffix(statement, "\000"), buf.Bytes(), nil
+}
+
+// GetTarget returns the target type ('S' or 'P') and name of a Describe or Close message.
+func GetTarget(msg []byte) (target byte, name string, err error) {
+	if len(msg) < 5 {
+		return 0, "", fmt.Errorf("invalid Describe or Close length %d", len(msg))
+	}
+	buf := bytes.NewBuffer(msg[5:])
+	if target, err = buf.ReadByte(); err != nil {
+		return
+	}
+	if name, err = buf.ReadString(0x00); err != nil {
+		return
+	}
+	return target, strings.TrimSuffix(name, "\000"), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// truncations returns every proper prefix of msg.
+func truncations(msg []byte) (prefixes [][]byte) {
+	for n := 0; n < len(msg); n++ {
+		prefixes = append(prefixes, msg[:n])
+	}
+	return prefixes
+}
+
+func TestGetParseMessage(t *testing.T) {
+	msg, err := CreateParseMessage("s1", "SELECT $1", []int32{23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, query, parameterOIDs, err := GetParseMessage(msg)
+	if err != nil || name != "s1" || query != "SELECT $1" || !reflect.DeepEqual(parameterOIDs, []int32{23}) {
+		t.Fatalf("GetParseMessage() = %q, %q, %v, %v", name, query, parameterOIDs, err)
+	}
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{name: "parameter count larger than the types", msg: append(msg[:len(msg)-6:len(msg)-6], 0, 2, 0, 0, 0, 23)},
+		{name: "parameter count of 65535", msg: append(msg[:len(msg)-6:len(msg)-6], 0xff, 0xff, 0, 0, 0, 23)},
+		{name: "bytes after the parameter types", msg: append(msg[:len(msg):len(msg)], 0)},
+	}
+	for _, prefix := range truncations(msg) {
+		tests = append(tests, struct {
+			name string
+			msg  []byte
+		}{name: "truncated", msg: prefix})
+	}
+	for _, test := range tests {
+		if _, _, _, err := GetParseMessage(test.msg); err == nil {
+			t.Errorf("%v: GetParseMessage(%q) returned no error", test.name, test.msg)
+		}
+	}
+}
+
+func TestGetBindMessage(t *testing.T) {
+	msg, err := CreateBindMessage("p1", "s1", []byte{0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	portal, statement, parameters, err := GetBindMessage(msg)
+	if err != nil || portal != "p1" || statement != "s1" || len(parameters) != 6 {
+		t.Fatalf("GetBindMessage() = %q, %q, %v, %v", portal, statement, parameters, err)
+	}
+	// Every prefix that ends before the statement name is complete fails
+	for _, prefix := range truncations(msg)[:len(msg)-6] {
+		if _, _, _, err := GetBindMessage(prefix); err == nil {
+			t.Errorf("GetBindMessage(%q) returned no error", prefix)
+		}
+	}
+}
+
+func TestGetTarget(t *testing.T) {
+	msg, err := CreateTargetMessage(MessageTypeDescribe, TargetPreparedStatement, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, name, err := GetTarget(msg); err != nil || target != TargetPreparedStatement || name != "s1" {
+		t.Fatalf("GetTarget() = %q, %q, %v", target, name, err)
+	}
+	for _, prefix := range truncations(msg) {
+		if _, _, err := GetTarget(prefix); err == nil {
+			t.Errorf("GetTarget(%q) returned no error", prefix)
+		}
+	}
+}
+
+func TestGetStartupMessageAttributes(t *testing.T) {
+	msg, err := CreateStartupMessage(ProtocolVersion, "alice", "app", map[string]string{"application_name": "psql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := map[string]string{"user": "alice", "database": "app", "application_name": "psql"}
+	if attributes := GetStartupMessageAttributes(msg); !reflect.DeepEqual(attributes, complete) {
+		t.Fatalf("GetStartupMessageAttributes() = %v, want %v", attributes, complete)
+	}
+	// A truncated message yields the attributes before the cut, and never one with a cut key or value
+	for _, prefix := range truncations(msg) {
+		for key, value := range GetStartupMessageAttributes(prefix) {
+			if complete[key] != value {
+				t.Errorf("GetStartupMessageAttributes(%q) has %q = %q", prefix, key, value)
+			}
+		}
+	}
+}
+
+func TestGetTransactionStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    []byte
+		status byte
+		err    bool
+	}{
+		{name: "idle", msg: []byte{MessageTypeReadyForQuery, 0, 0, 0, 5, TransactionStatusIdle}, status: TransactionStatusIdle},
+		{name: "in a transaction", msg: []byte{MessageTypeReadyForQuery, 0, 0, 0, 5, TransactionStatusInTransaction},
+			status: TransactionStatusInTransaction},
+		{name: "without status", msg: []byte{MessageTypeReadyForQuery, 0, 0, 0, 4}, err: true},
+		{name: "empty", msg: nil, err: true},
+	}
+	for _, test := range tests {
+		status, err := GetTransactionStatus(test.msg)
+		if (err != nil) != test.err || status != test.status {
+			t.Errorf("%v: GetTransactionStatus(%q) = %q, %v", test.name, test.msg, status, err)
+		}
+	}
+}